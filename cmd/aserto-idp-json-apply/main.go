@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/diff"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/srv"
+)
+
+func main() {
+	changesFile := flag.String("changes", "", "change-set file, as written by aserto-idp-json-diff -json")
+	out := flag.String("out", "", "file the changed users are written to, the input file when not set")
+	asJSON := flag.Bool("json", false, "print the results as JSON")
+	passphraseEnv := flag.String("encryption-passphrase-env", "", "environment variable holding the passphrase of encrypted files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -changes <change-set> [flags] <users>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *changesFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	changes, err := diff.LoadChanges(*changesFile)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	conf := &config.JSONPluginConfig{
+		FromFile:      flag.Arg(0),
+		ToFile:        *out,
+		PassphraseEnv: *passphraseEnv,
+	}
+	if conf.ToFile == "" {
+		conf.ToFile = conf.FromFile
+	}
+
+	results, err := srv.Apply(conf, changes)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, result := range results {
+		failed = failed || result.Status != srv.ChangeApplied
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	} else {
+		for _, result := range results {
+			if _, err = fmt.Println(result.String()); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/diff"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/srv"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "print the changes as JSON patches instead of a summary")
+	profile := flag.String("profile", "", "source export profile of both files: aserto (default), okta or azuread")
+	format := flag.String("format", config.FormatJSON, "file format of both files: json or ldif")
+	passphraseEnv := flag.String("encryption-passphrase-env", "", "environment variable holding the passphrase of encrypted files")
+	identityFile := flag.String("age-identity-file", "", "age identity file decrypting encrypted files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <before> <after>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	read := func(file string) []*api.User {
+		users, err := srv.ReadUsers(&config.JSONPluginConfig{
+			FromFile:      file,
+			Profile:       *profile,
+			Format:        *format,
+			PassphraseEnv: *passphraseEnv,
+			IdentityFile:  *identityFile,
+		})
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		return users
+	}
+
+	report, err := diff.Users(read(flag.Arg(0)), read(flag.Arg(1)))
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		err = report.WriteSummary(os.Stdout)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if len(report.Changes) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/generator"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/srv"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+)
+
+func main() {
+	out := flag.String("out", "users.json", "file the generated users are written to")
+	format := flag.String("format", config.FormatJSON, "output format: json or ldif")
+	count := flag.Int("count", 100, "number of users to generate")
+	seed := flag.Int64("seed", 1, "seed of the generator, equal seeds generate equal users")
+	deleted := flag.Float64("deleted-ratio", 0.05, "ratio of soft deleted users")
+	domain := flag.String("domain", "acmecorp.com", "email domain of the generated users")
+	flag.Parse()
+
+	conf := &config.JSONPluginConfig{
+		ToFile: *out,
+		Format: *format,
+	}
+	if err := conf.Validate(plugin.OperationTypeWrite); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	JSONplugin := srv.NewJSONPlugin()
+	if err := JSONplugin.Open(conf, plugin.OperationTypeWrite); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	opts := generator.Options{
+		Count:        *count,
+		Seed:         *seed,
+		DeletedRatio: *deleted,
+		Domain:       *domain,
+	}
+	err := generator.Generate(opts, func(user *api.User) error {
+		return JSONplugin.Write(user)
+	})
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if _, err := JSONplugin.Close(); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
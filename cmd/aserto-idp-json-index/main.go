@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/srv"
+)
+
+func main() {
+	profile := flag.String("profile", "", "source export profile of the files: aserto (default), okta or azuread")
+	usersPath := flag.String("users-path", "", "path of the users array in the files, e.g. data.users")
+	verifyKeyFile := flag.String("verify-key-file", "", "PEM ed25519 public key the signatures of the files are verified with")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <users>\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "writes the index of a user file, or of every file of a directory or glob")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := srv.BuildIndex(&config.JSONPluginConfig{
+		FromFile:      flag.Arg(0),
+		Profile:       *profile,
+		UsersPath:     *usersPath,
+		VerifyKeyFile: *verifyKeyFile,
+	})
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
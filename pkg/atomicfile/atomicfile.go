@@ -0,0 +1,82 @@
+// Package atomicfile replaces files so that an interruption never leaves a
+// truncated one: the content is written aside and renamed in place of the file
+// once it is on disk.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// File is written aside the file it replaces and renamed in place of it when
+// committed.
+type File struct {
+	*os.File
+	name string
+}
+
+// Create starts the replacement of the file name. The replacement keeps the
+// mode of name when it exists, perm applies otherwise.
+func Create(name string, perm os.FileMode) (*File, error) {
+	tmp := fmt.Sprintf("%s.%d.tmp", name, time.Now().UnixNano())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{File: f, name: name}, nil
+}
+
+// Target returns the name of the file replaced.
+func (f *File) Target() string {
+	return f.name
+}
+
+// Commit puts the content written in place of the file.
+func (f *File) Commit() error {
+	defer f.Abort()
+
+	if info, err := os.Stat(f.name); err == nil {
+		if err := f.Chmod(info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	// the content must be on disk before it replaces the file
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.name); err != nil {
+		return err
+	}
+	f.File = nil
+
+	return nil
+}
+
+// Abort discards the content written, if it was not committed.
+func (f *File) Abort() {
+	if f.File == nil {
+		return
+	}
+	f.Close()           // nolint:errcheck // the file is removed
+	os.Remove(f.Name()) // nolint:errcheck // best effort
+	f.File = nil
+}
+
+// WriteFile replaces the content of the file name with b.
+func WriteFile(name string, b []byte, perm os.FileMode) error {
+	f, err := Create(name, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Abort()
+		return err
+	}
+
+	return f.Commit()
+}
@@ -0,0 +1,52 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileKeepsMode(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "watermark")
+	assert.Nil(os.WriteFile(name, []byte("old\n"), 0640))
+	assert.Nil(os.Chmod(name, 0640))
+
+	assert.Nil(WriteFile(name, []byte("new\n"), 0600))
+
+	content, err := os.ReadFile(name)
+	assert.Nil(err)
+	assert.Equal("new\n", string(content))
+	info, err := os.Stat(name)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0640), info.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(entries, 1, "the file written aside should be renamed")
+}
+
+func TestAbort(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "users.json")
+	assert.Nil(os.WriteFile(name, []byte("old\n"), 0600))
+
+	f, err := Create(name, 0600)
+	assert.Nil(err)
+	_, err = f.Write([]byte("new\n"))
+	assert.Nil(err)
+	f.Abort()
+
+	content, err := os.ReadFile(name)
+	assert.Nil(err)
+	assert.Equal("old\n", string(content))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(entries, 1, "the file written aside should be removed")
+}
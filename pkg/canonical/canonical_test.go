@@ -0,0 +1,35 @@
+package canonical
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransform(t *testing.T) {
+	assert := require.New(t)
+
+	b, err := Transform([]byte(`{
+		"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000001, 1e-7, -0],
+		"string": "€$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+		"literals": [null, true, false],
+		"b": 1, "a": 2, "é": 3, "😀": 4, "ﬁ": 5
+	}`))
+	assert.Nil(err)
+
+	expected := `{"a":2,"b":1,"literals":[null,true,false],` +
+		`"numbers":[333333333.3333333,1e+30,4.5,0.002,0.000001,1e-7,0],` +
+		`"string":"€$\u000f\nA'B\"\\\\\"/","é":3,"😀":4,"ﬁ":5}`
+	assert.Equal(expected, string(b))
+}
+
+func TestTransformIsStable(t *testing.T) {
+	assert := require.New(t)
+
+	first, err := Transform([]byte(`{"id": "1", "identities": {"b": {}, "a": {}}}`))
+	assert.Nil(err)
+	second, err := Transform([]byte(`{"identities":{"a":{},"b":{}},"id":"1"}`))
+	assert.Nil(err)
+
+	assert.Equal(first, second)
+}
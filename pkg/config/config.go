@@ -3,8 +3,18 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/encryption"
 	fileaccess "github.com/aserto-dev/aserto-idp-plugin-json/pkg/file-access"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/filter"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/jsonpath"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/ldif"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/profile"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/signature"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/transform"
 	"github.com/aserto-dev/idp-plugin-sdk/plugin"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc/codes"
@@ -22,20 +32,92 @@ func GetVersion() (string, string, string) {
 	return ver, date, commit
 }
 
+const (
+	FormatJSON = "json"
+	FormatLDIF = "ldif"
+)
+
+const (
+	SortByID          = "id"
+	SortByEmail       = "email"
+	SortByDisplayName = "display_name"
+	SortByCreatedAt   = "created_at"
+)
+
+const (
+	DeleteByID       = "id"
+	DeleteByEmail    = "email"
+	DeleteByIdentity = "identity"
+	DeleteByAny      = "any"
+)
+
+const (
+	StylePretty    = "pretty"
+	StyleCompact   = "compact"
+	StyleCanonical = "canonical"
+)
+
 type JSONPluginConfig struct {
-	FromFile string `description:"Json file path to read or delete from" kind:"attribute" mode:"normal" readonly:"false" name:"from-file"`
-	ToFile   string `description:"Json file path to write to" kind:"attribute" mode:"normal" readonly:"false" name:"to-file"`
+	FromFile         string `description:"Json file path to read or delete from" kind:"attribute" mode:"normal" readonly:"false" name:"from-file"`
+	ToFile           string `description:"Json file path to write to" kind:"attribute" mode:"normal" readonly:"false" name:"to-file"`
+	Profile          string `description:"Source export profile of from-file: aserto (default), okta or azuread" kind:"attribute" mode:"normal" readonly:"false" name:"profile"`
+	Format           string `description:"File format: json (default) or ldif" kind:"attribute" mode:"normal" readonly:"false" name:"format"`
+	LDIFAttributeMap string `description:"Comma separated LDAP attribute=user field pairs overriding the default LDIF mapping" kind:"attribute" mode:"normal" readonly:"false" name:"ldif-attribute-map"`
+	LDIFBaseDN       string `description:"Base DN of the entries written to LDIF" kind:"attribute" mode:"normal" readonly:"false" name:"ldif-base-dn"`
+	UsersPath        string `description:"Dotted path or JSON pointer of the users array inside a wrapping document" kind:"attribute" mode:"normal" readonly:"false" name:"users-path"`
+	WriteTemplate    string `description:"JSON document in which the written users array is placed at users-path" kind:"attribute" mode:"normal" readonly:"false" name:"write-template"`
+	ShardMaxUsers    int    `description:"Roll over to a new numbered to-file after this many users" kind:"attribute" mode:"normal" readonly:"false" name:"shard-max-users"`
+	ShardMaxBytes    int    `description:"Roll over to a new numbered to-file before it exceeds this many bytes" kind:"attribute" mode:"normal" readonly:"false" name:"shard-max-bytes"`
+	ShardBy          string `description:"User field path to partition to-file by, e.g. attributes.properties.department" kind:"attribute" mode:"normal" readonly:"false" name:"shard-by"`
+	PassphraseEnv    string `description:"Environment variable holding the passphrase used to encrypt and decrypt user files" kind:"attribute" mode:"normal" readonly:"false" name:"encryption-passphrase-env"`
+	RecipientsFile   string `description:"age recipients file used to encrypt written user files" kind:"attribute" mode:"normal" readonly:"false" name:"age-recipients-file"`
+	IdentityFile     string `description:"age identity file used to decrypt user files" kind:"attribute" mode:"normal" readonly:"false" name:"age-identity-file"`
+	SigningKeyFile   string `description:"PEM ed25519 private key used to sign the checksum manifest of written files" kind:"attribute" mode:"normal" readonly:"false" name:"signing-key-file"`
+	VerifyKeyFile    string `description:"PEM ed25519 public key used to verify the signature of files before reading them" kind:"attribute" mode:"normal" readonly:"false" name:"verify-key-file"`
+	Redact           string `description:"Comma separated field=action pairs (drop, mask or hash) applied to written users, e.g. email=hash,picture=drop" kind:"attribute" mode:"normal" readonly:"false" name:"redact"`
+	RedactKeyEnv     string `description:"Environment variable holding the HMAC key used by hash redactions" kind:"attribute" mode:"normal" readonly:"false" name:"redact-key-env"`
+	Normalize        string `description:"Comma separated identity normalizers applied on read and write: email, phone, keys, kind or all" kind:"attribute" mode:"normal" readonly:"false" name:"normalize"`
+	PhoneCountryCode string `description:"Country calling code given to phone identities without one when normalizing, e.g. 1" kind:"attribute" mode:"normal" readonly:"false" name:"phone-country-code"`
+	IDStrategy       string `description:"Handling of users without an id: keep (default), fail, uuid4 or uuid5" kind:"attribute" mode:"normal" readonly:"false" name:"id-strategy"`
+	IDIdentity       string `description:"Identity kind uuid5 ids are derived from: email (default), username, pid, dn or phone" kind:"attribute" mode:"normal" readonly:"false" name:"id-identity"`
+	RoleMapFile      string `description:"JSON file renaming the roles of read and written users and listing the permissions they imply" kind:"attribute" mode:"normal" readonly:"false" name:"role-map-file"`
+	UnmappedRoles    string `description:"Handling of roles missing from role-map-file: keep (default), drop or fail" kind:"attribute" mode:"normal" readonly:"false" name:"unmapped-roles"`
+	FillTimestamps   bool   `description:"Set missing created_at and updated_at of written users and bump updated_at of replaced users that changed and of deleted users" kind:"attribute" mode:"normal" readonly:"false" name:"fill-timestamps"`
+	PreserveUnknown  bool   `description:"Accept fields of aserto records that are not part of a user and keep them when delete rewrites from-file" kind:"attribute" mode:"normal" readonly:"false" name:"preserve-unknown"`
+	OutputStyle      string `description:"Formatting of written JSON records: pretty (default), compact or canonical (RFC 8785 with sorted roles)" kind:"attribute" mode:"normal" readonly:"false" name:"output-style"`
+	Indent           int    `description:"Number of spaces pretty records are indented with, 2 when not set" kind:"attribute" mode:"normal" readonly:"false" name:"indent"`
+	EmitUnpopulated  bool   `description:"Write the fields of users that are not set" kind:"attribute" mode:"normal" readonly:"false" name:"emit-unpopulated"`
+	EnumNumbers      bool   `description:"Write enum values, such as identity kinds, as numbers instead of names" kind:"attribute" mode:"normal" readonly:"false" name:"enum-numbers"`
+	SortBy           string `description:"Field written users are sorted by: id, email, display_name or created_at" kind:"attribute" mode:"normal" readonly:"false" name:"sort-by"`
+	SortBuffer       int    `description:"Number of users sorted in memory before they are spilled to a temporary file, 10000 when not set" kind:"attribute" mode:"normal" readonly:"false" name:"sort-buffer"`
+	Since            string `description:"Only read users created, updated or deleted after this RFC 3339 time, overrides watermark-file" kind:"attribute" mode:"normal" readonly:"false" name:"since"`
+	WatermarkFile    string `description:"File holding the change time of the newest user of the last successful read, only newer users are read" kind:"attribute" mode:"normal" readonly:"false" name:"watermark-file"`
+	CheckpointFile   string `description:"File the position of a read is saved to, an interrupted read resumes from it" kind:"attribute" mode:"normal" readonly:"false" name:"checkpoint-file"`
+	CheckpointEvery  int    `description:"Number of users read between two checkpoints, 1000 when not set" kind:"attribute" mode:"normal" readonly:"false" name:"checkpoint-interval"`
+	WriteIndex       bool   `description:"Write a sidecar index of the record offsets by id and identity next to every written file" kind:"attribute" mode:"normal" readonly:"false" name:"write-index"`
+	DeleteBy         string `description:"What delete keys are matched against: id (default), email, identity (identity keys) or any of them" kind:"attribute" mode:"normal" readonly:"false" name:"delete-by"`
+	DeleteFilter     string `description:"Comma separated field=value and field!=value conditions, the users matching all of them are deleted, e.g. email=*@contractor.com" kind:"attribute" mode:"normal" readonly:"false" name:"delete-filter"`
+	DeleteReport     string `description:"JSON file listing the users matched by every delete key and by delete-filter" kind:"attribute" mode:"normal" readonly:"false" name:"delete-report"`
+	Restore          bool   `description:"Restore the deleted users matched by the delete keys and delete-filter instead of deleting users" kind:"attribute" mode:"normal" readonly:"false" name:"restore"`
+	DryRun           bool   `description:"Compute the users written, deleted and restored without writing any file" kind:"attribute" mode:"normal" readonly:"false" name:"dry-run"`
+	PreviewDir       string `description:"Directory a dry run writes the files it would have written to, along with dry-run-plan.json" kind:"attribute" mode:"normal" readonly:"false" name:"preview-dir"`
+	LockTimeout      string `description:"How long write and delete wait for another invocation to release the lock of their file, e.g. 30s; they fail at once when not set" kind:"attribute" mode:"normal" readonly:"false" name:"lock-timeout"`
 }
 
 func (c *JSONPluginConfig) Validate(operation plugin.OperationType) error {
 
+	err := c.validateOptions(operation)
+	if err != nil {
+		return err
+	}
+
 	switch operation {
 	case plugin.OperationTypeWrite:
 		// TODO accept stdout
 		if c.ToFile == "" {
 			return status.Error(codes.InvalidArgument, "no json file 'to_file' name was provided")
 		}
-		err := validateWrite(c.ToFile)
+		err = validateWrite(c.ToFile)
 		if err != nil {
 			return err
 		}
@@ -43,15 +125,28 @@ func (c *JSONPluginConfig) Validate(operation plugin.OperationType) error {
 		if c.FromFile == "" {
 			return status.Error(codes.InvalidArgument, "no json file 'from_file' name was provided")
 		}
-		err := validateRead(c.FromFile)
+		files, err := c.SourceFiles()
 		if err != nil {
 			return err
 		}
+		for _, file := range files {
+			err = c.validateSource(file)
+			if err != nil {
+				return err
+			}
+		}
 	case plugin.OperationTypeDelete:
 		if c.FromFile == "" {
 			return status.Error(codes.InvalidArgument, "no json file 'from_file' name was provided")
 		}
-		err := validateRead(c.FromFile)
+		err = validateRead(c.FromFile)
+		if err != nil {
+			return err
+		}
+		if info, _ := os.Stat(c.FromFile); info.IsDir() {
+			return status.Errorf(codes.InvalidArgument, "'%s' is a directory, delete requires a single file", c.FromFile)
+		}
+		err = c.validateSource(c.FromFile)
 		if err != nil {
 			return err
 		}
@@ -61,13 +156,319 @@ func (c *JSONPluginConfig) Validate(operation plugin.OperationType) error {
 		}
 	}
 
+	return c.ValidatePreviewDir(operation)
+}
+
+// ValidatePreviewDir checks that the previews of a dry run cannot overwrite the
+// file written by operation, which they would in the directory of that file.
+func (c *JSONPluginConfig) ValidatePreviewDir(operation plugin.OperationType) error {
+	if c.PreviewDir == "" {
+		return nil
+	}
+
+	var file string
+	switch operation {
+	case plugin.OperationTypeWrite:
+		file = c.ToFile
+	case plugin.OperationTypeDelete:
+		file = c.FromFile
+	default:
+		return nil
+	}
+
+	if sameDir(c.PreviewDir, filepath.Dir(file)) {
+		return status.Errorf(codes.InvalidArgument, "preview-dir '%s' is the directory of '%s'", c.PreviewDir, file)
+	}
 	return nil
 }
 
+// sameDir reports whether the paths a and b resolve to the same directory.
+func sameDir(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA == nil && errB == nil {
+		return os.SameFile(infoA, infoB)
+	}
+
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
 func (c *JSONPluginConfig) Description() string {
 	return "JSON plugin"
 }
 
+// Keys returns the encryption keys configured, nil when files are not encrypted.
+func (c *JSONPluginConfig) Keys() (*encryption.Keys, error) {
+	return encryption.Load(c.PassphraseEnv, c.RecipientsFile, c.IdentityFile)
+}
+
+// Redactor returns the redaction applied to written users.
+func (c *JSONPluginConfig) Redactor() (*transform.Redactor, error) {
+	var key []byte
+	if c.RedactKeyEnv != "" {
+		key = []byte(os.Getenv(c.RedactKeyEnv))
+	}
+	return transform.NewRedactor(c.Redact, key)
+}
+
+// Normalizer returns the identity normalization applied to read and written users.
+func (c *JSONPluginConfig) Normalizer() (*transform.Normalizer, error) {
+	return transform.NewNormalizer(c.Normalize, c.PhoneCountryCode)
+}
+
+// IDAssigner returns the assignment of ids to read and written users without one.
+func (c *JSONPluginConfig) IDAssigner() (*transform.IDAssigner, error) {
+	return transform.NewIDAssigner(c.IDStrategy, c.IDIdentity)
+}
+
+// RoleMapper returns the role mapping applied to read and written users, nil when
+// no role-map-file is configured.
+func (c *JSONPluginConfig) RoleMapper() (*transform.RoleMapper, error) {
+	if c.RoleMapFile == "" {
+		return nil, nil
+	}
+	return transform.LoadRoleMapper(c.RoleMapFile, c.UnmappedRoles)
+}
+
+// ChangedSince returns the time users must have changed after to be read, zero
+// when every user is read. It is the since option or else the content of the
+// watermark file, when that exists.
+func (c *JSONPluginConfig) ChangedSince() (time.Time, error) {
+	value := c.Since
+	if value == "" && c.WatermarkFile != "" {
+		content, err := os.ReadFile(c.WatermarkFile)
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		value = strings.TrimSpace(string(content))
+	}
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time '%s', expected RFC 3339", value)
+	}
+	return since, nil
+}
+
+// LockWait returns how long the lock of the written file is waited for.
+func (c *JSONPluginConfig) LockWait() (time.Duration, error) {
+	if c.LockTimeout == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(c.LockTimeout)
+	if err != nil || wait < 0 {
+		return 0, errors.Errorf("invalid lock timeout '%s', expected a duration such as 30s", c.LockTimeout)
+	}
+	return wait, nil
+}
+
+// SourceFiles resolves from-file, which is a file, a directory or a glob pattern,
+// to the list of files to read in lexical order. The files of a directory are the
+// ones with the extension of the configured format.
+func (c *JSONPluginConfig) SourceFiles() ([]string, error) {
+	info, err := os.Stat(c.FromFile)
+	if err == nil && info.IsDir() {
+		entries, err := os.ReadDir(c.FromFile)
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		ext := "." + FormatJSON
+		if c.Format == FormatLDIF {
+			ext = "." + FormatLDIF
+		}
+
+		files := []string{}
+		for _, entry := range entries {
+			if !entry.IsDir() && filepath.Ext(entry.Name()) == ext {
+				files = append(files, filepath.Join(c.FromFile, entry.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, status.Errorf(codes.NotFound, "no '%s' files found in '%s'", ext, c.FromFile)
+		}
+		return files, nil
+	}
+
+	if err == nil || !strings.ContainsAny(c.FromFile, "*?[") {
+		return []string{c.FromFile}, nil
+	}
+
+	matches, err := filepath.Glob(c.FromFile)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid pattern '%s': %s", c.FromFile, err.Error())
+	}
+
+	files := []string{}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			files = append(files, match)
+		}
+	}
+	if len(files) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no files match '%s'", c.FromFile)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// validateOptions checks the options that do not depend on the file system.
+func (c *JSONPluginConfig) validateOptions(operation plugin.OperationType) error {
+	p, ok := profile.Get(c.Profile)
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown profile '%s'", c.Profile)
+	}
+	if p.Name != profile.Aserto && operation != plugin.OperationTypeRead {
+		return status.Errorf(codes.InvalidArgument, "profile '%s' can only be used for read", p.Name)
+	}
+
+	switch c.Format {
+	case "", FormatJSON:
+	case FormatLDIF:
+		if p.Name != profile.Aserto {
+			return status.Errorf(codes.InvalidArgument, "profile '%s' cannot be used with the ldif format", p.Name)
+		}
+		if operation == plugin.OperationTypeDelete {
+			return status.Error(codes.InvalidArgument, "the ldif format does not support delete")
+		}
+		if c.CheckpointFile != "" {
+			return status.Error(codes.InvalidArgument, "the ldif format does not support checkpoints")
+		}
+		if c.WriteIndex {
+			return status.Error(codes.InvalidArgument, "the ldif format does not support indexes")
+		}
+		if _, err := ldif.ParseAttributeMap(c.LDIFAttributeMap); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown format '%s'", c.Format)
+	}
+
+	path, err := jsonpath.Parse(c.UsersPath)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.WriteTemplate != "" {
+		if len(path) == 0 {
+			return status.Error(codes.InvalidArgument, "write-template requires users-path")
+		}
+		if _, _, err := jsonpath.Wrap([]byte(c.WriteTemplate), path); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	switch c.OutputStyle {
+	case "", StylePretty, StyleCompact, StyleCanonical:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown output style '%s'", c.OutputStyle)
+	}
+	if c.Indent < 0 {
+		return status.Error(codes.InvalidArgument, "indent cannot be negative")
+	}
+
+	switch c.SortBy {
+	case "", SortByID, SortByEmail, SortByDisplayName, SortByCreatedAt:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown sort field '%s'", c.SortBy)
+	}
+	switch c.DeleteBy {
+	case "", DeleteByID, DeleteByEmail, DeleteByIdentity, DeleteByAny:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown delete key '%s'", c.DeleteBy)
+	}
+	if c.DeleteFilter != "" {
+		if _, err := filter.Parse(c.DeleteFilter); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if c.PreviewDir != "" && !c.DryRun {
+		return status.Error(codes.InvalidArgument, "preview-dir requires dry-run")
+	}
+
+	if c.CheckpointEvery < 0 {
+		return status.Error(codes.InvalidArgument, "checkpoint-interval cannot be negative")
+	}
+	if c.SortBuffer < 0 {
+		return status.Error(codes.InvalidArgument, "sort-buffer cannot be negative")
+	}
+
+	if c.ShardMaxUsers < 0 || c.ShardMaxBytes < 0 {
+		return status.Error(codes.InvalidArgument, "shard limits cannot be negative")
+	}
+	if _, err := jsonpath.Parse(c.ShardBy); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	keys, err := c.Keys()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if c.WriteIndex && keys.CanEncrypt() {
+		return status.Error(codes.InvalidArgument, "encrypted files cannot be indexed")
+	}
+
+	if c.SigningKeyFile != "" {
+		if _, err := signature.LoadPrivateKey(c.SigningKeyFile); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if c.VerifyKeyFile != "" {
+		if _, err := signature.LoadPublicKey(c.VerifyKeyFile); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if _, err := c.Redactor(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := c.Normalizer(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := c.IDAssigner(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := c.RoleMapper(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := c.ChangedSince(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := c.LockWait(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return nil
+}
+
+// validateSource checks that file can be read and, when encrypted, decrypted.
+func (c *JSONPluginConfig) validateSource(file string) error {
+	err := validateRead(file)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryption.IsEncrypted(file)
+	if err != nil {
+		return status.Errorf(codes.PermissionDenied, "cannot access '%s' for read", file)
+	}
+	if encrypted && c.PassphraseEnv == "" && c.IdentityFile == "" {
+		return status.Errorf(codes.InvalidArgument, "'%s' is encrypted but no decryption key is configured", file)
+	}
+
+	return nil
+}
+
 func validateRead(file string) error {
 	path, err := os.Stat(file)
 
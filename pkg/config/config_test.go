@@ -147,6 +147,117 @@ func TestValidateWriteWithFileInInvalidPath(t *testing.T) {
 	assert.Regexp(r, err.Error())
 }
 
+func TestValidateUnknownProfile(t *testing.T) {
+	assert := require.New(t)
+	config := JSONPluginConfig{
+		FromFile: "test",
+		Profile:  "ldap",
+	}
+	err := config.Validate(plugin.OperationTypeRead)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = unknown profile 'ldap'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateWriteWithReadOnlyProfile(t *testing.T) {
+	assert := require.New(t)
+	config := JSONPluginConfig{
+		ToFile:  "test",
+		Profile: "okta",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = profile 'okta' can only be used for read")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateUnknownFormat(t *testing.T) {
+	assert := require.New(t)
+	config := JSONPluginConfig{
+		ToFile: "test",
+		Format: "xml",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = unknown format 'xml'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateInvalidLDIFAttributeMap(t *testing.T) {
+	assert := require.New(t)
+	config := JSONPluginConfig{
+		ToFile:           "test",
+		Format:           "ldif",
+		LDIFAttributeMap: "uid",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = invalid attribute mapping 'uid'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateWriteTemplateWithoutUsersPath(t *testing.T) {
+	assert := require.New(t)
+	config := JSONPluginConfig{
+		ToFile:        "test",
+		WriteTemplate: `{"data":{"users":[]}}`,
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = write-template requires users-path")
+	assert.Regexp(r, err.Error())
+}
+
+func TestSourceFilesFromDirectory(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	config := JSONPluginConfig{
+		FromFile: filepath.Join(filepath.Dir(currentDir), "testing", "departments"),
+	}
+	files, err := config.SourceFiles()
+	assert.Nil(err)
+	assert.Equal(3, len(files))
+	assert.Equal("engineering.json", filepath.Base(files[0]))
+	assert.Equal("sales.json", filepath.Base(files[1]))
+	assert.Equal("support.json", filepath.Base(files[2]))
+}
+
+func TestSourceFilesWithoutMatch(t *testing.T) {
+	assert := require.New(t)
+	config := JSONPluginConfig{
+		FromFile: "testing/*.json",
+	}
+	err := config.Validate(plugin.OperationTypeRead)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("NotFound desc = no files match 'testing/\\*.json'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateDeleteWithDirectory(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	config := JSONPluginConfig{
+		FromFile: filepath.Join(filepath.Dir(currentDir), "testing", "departments"),
+	}
+	err = config.Validate(plugin.OperationTypeDelete)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = '.*departments' is a directory, delete requires a single file")
+	assert.Regexp(r, err.Error())
+}
+
 func TestDescription(t *testing.T) {
 	assert := require.New(t)
 	config := JSONPluginConfig{}
@@ -156,3 +267,108 @@ func TestDescription(t *testing.T) {
 	assert.Equal("JSON plugin", description, "should return the description of the plugin")
 
 }
+
+func TestValidateUnknownNormalizer(t *testing.T) {
+	assert := require.New(t)
+
+	config := JSONPluginConfig{
+		ToFile:    "users.json",
+		Normalize: "email,case",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = unknown normalizer 'case'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateUnknownOutputStyle(t *testing.T) {
+	assert := require.New(t)
+
+	config := JSONPluginConfig{
+		ToFile:      "users.json",
+		OutputStyle: "minified",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = unknown output style 'minified'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateEncryptedIndex(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_INDEX_PASSPHRASE", "secret")
+	config := JSONPluginConfig{
+		ToFile:        "users.json",
+		PassphraseEnv: "TEST_JSON_INDEX_PASSPHRASE",
+		WriteIndex:    true,
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = encrypted files cannot be indexed")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidateInvalidDeleteFilter(t *testing.T) {
+	assert := require.New(t)
+
+	config := JSONPluginConfig{
+		ToFile:       "users.json",
+		DeleteFilter: "email",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = invalid condition 'email'")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidatePreviewDirWithoutDryRun(t *testing.T) {
+	assert := require.New(t)
+
+	config := JSONPluginConfig{
+		ToFile:     "users.json",
+		PreviewDir: "preview",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = preview-dir requires dry-run")
+	assert.Regexp(r, err.Error())
+}
+
+func TestValidatePreviewDirOfOutput(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	config := JSONPluginConfig{
+		ToFile:     filepath.Join(dir, "users.json"),
+		DryRun:     true,
+		PreviewDir: dir + string(filepath.Separator),
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = preview-dir '.*' is the directory of '.*users.json'")
+	assert.Regexp(r, err.Error())
+
+	config.PreviewDir = filepath.Join(dir, "preview")
+	assert.Nil(config.Validate(plugin.OperationTypeWrite))
+}
+
+func TestValidateInvalidLockTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	config := JSONPluginConfig{
+		ToFile:      "users.json",
+		LockTimeout: "30",
+	}
+	err := config.Validate(plugin.OperationTypeWrite)
+
+	assert.NotNil(err)
+	r := regexp.MustCompile("InvalidArgument desc = invalid lock timeout '30', expected a duration such as 30s")
+	assert.Regexp(r, err.Error())
+}
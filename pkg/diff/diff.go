@@ -0,0 +1,223 @@
+// Package diff compares two sets of users matched by id.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Kinds of user changes.
+const (
+	Added    = "added"
+	Removed  = "removed"
+	Deleted  = "deleted"
+	Restored = "restored"
+	Modified = "modified"
+)
+
+// JSON Patch operations.
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+)
+
+var jsonOptions = protojson.MarshalOptions{ // nolint:gochecknoglobals // constant
+	UseProtoNames: true,
+}
+
+// Operation is a JSON Patch (RFC 6902) operation on a user document.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Change describes how a user differs between the two sets. Added users carry
+// the new user, deleted, restored and modified users the patch turning the old
+// user into the new one.
+type Change struct {
+	ID     string                 `json:"id"`
+	Change string                 `json:"change"`
+	User   map[string]interface{} `json:"user,omitempty"`
+	Patch  []*Operation           `json:"patch,omitempty"`
+}
+
+// Summary counts the changes by kind.
+type Summary struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Deleted  int `json:"deleted"`
+	Restored int `json:"restored"`
+	Modified int `json:"modified"`
+}
+
+// Report lists the changes in id order.
+type Report struct {
+	Summary Summary   `json:"summary"`
+	Changes []*Change `json:"changes"`
+}
+
+// Users compares the users before to the users after.
+func Users(before, after []*api.User) (*Report, error) {
+	old, err := index(before)
+	if err != nil {
+		return nil, err
+	}
+	current, err := index(after)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(old)+len(current))
+	for id := range old {
+		ids = append(ids, id)
+	}
+	for id := range current {
+		if _, ok := old[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	report := &Report{Changes: []*Change{}}
+	for _, id := range ids {
+		a, inBefore := old[id]
+		b, inAfter := current[id]
+
+		var change *Change
+		switch {
+		case !inBefore:
+			change = &Change{ID: id, Change: Added, User: b}
+			report.Summary.Added++
+		case !inAfter:
+			change = &Change{ID: id, Change: Removed}
+			report.Summary.Removed++
+		default:
+			patch := compare(nil, a, b)
+			if len(patch) == 0 {
+				continue
+			}
+			change = &Change{ID: id, Patch: patch}
+			switch wasDeleted, isDeleted := a["deleted"] == true, b["deleted"] == true; {
+			case !wasDeleted && isDeleted:
+				change.Change = Deleted
+				report.Summary.Deleted++
+			case wasDeleted && !isDeleted:
+				change.Change = Restored
+				report.Summary.Restored++
+			default:
+				change.Change = Modified
+				report.Summary.Modified++
+			}
+		}
+		report.Changes = append(report.Changes, change)
+	}
+
+	return report, nil
+}
+
+// index returns the JSON documents of users by id.
+func index(users []*api.User) (map[string]map[string]interface{}, error) {
+	docs := make(map[string]map[string]interface{}, len(users))
+	for _, user := range users {
+		b, err := jsonOptions.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		if _, ok := docs[user.Id]; ok {
+			return nil, fmt.Errorf("duplicate user id '%s'", user.Id)
+		}
+		docs[user.Id] = doc
+	}
+	return docs, nil
+}
+
+// compare returns the operations turning a into b. Objects are compared key by
+// key, other values, including arrays such as roles, are replaced as a whole.
+func compare(path []string, a, b map[string]interface{}) []*Operation {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var ops []*Operation
+	for _, key := range keys {
+		va, inA := a[key]
+		vb, inB := b[key]
+		p := append(path[:len(path):len(path)], key)
+
+		switch {
+		case !inA:
+			ops = append(ops, &Operation{Op: OpAdd, Path: pointer(p), Value: vb})
+		case !inB:
+			ops = append(ops, &Operation{Op: OpRemove, Path: pointer(p)})
+		default:
+			oa, aIsObject := va.(map[string]interface{})
+			ob, bIsObject := vb.(map[string]interface{})
+			if aIsObject && bIsObject {
+				ops = append(ops, compare(p, oa, ob)...)
+			} else if !reflect.DeepEqual(va, vb) {
+				ops = append(ops, &Operation{Op: OpReplace, Path: pointer(p), Value: vb})
+			}
+		}
+	}
+	return ops
+}
+
+// pointer returns the JSON pointer (RFC 6901) of path.
+func pointer(path []string) string {
+	var sb strings.Builder
+	for _, segment := range path {
+		sb.WriteByte('/')
+		sb.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(segment))
+	}
+	return sb.String()
+}
+
+// WriteSummary writes a human readable account of the report to w.
+func (r *Report) WriteSummary(w io.Writer) error {
+	s := r.Summary
+	if _, err := fmt.Fprintf(w, "%d added, %d removed, %d deleted, %d restored, %d modified\n",
+		s.Added, s.Removed, s.Deleted, s.Restored, s.Modified); err != nil {
+		return err
+	}
+
+	for _, change := range r.Changes {
+		if _, err := fmt.Fprintf(w, "%-8s %s\n", change.Change, change.ID); err != nil {
+			return err
+		}
+		for _, op := range change.Patch {
+			line := fmt.Sprintf("  %s %s", op.Op, op.Path)
+			if op.Op != OpRemove {
+				value, err := json.Marshal(op.Value)
+				if err != nil {
+					return err
+				}
+				line += " " + string(value)
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
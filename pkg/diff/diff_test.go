@@ -0,0 +1,89 @@
+package diff
+
+import (
+	"bytes"
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func createTestUser(id, email string) *api.User {
+	return &api.User{
+		Id:    id,
+		Email: email,
+		Identities: map[string]*api.IdentitySource{
+			email: {Kind: api.IdentityKind_IDENTITY_KIND_EMAIL},
+		},
+		Attributes: &api.AttrSet{
+			Properties: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"department": structpb.NewStringValue("sales"),
+			}},
+			Roles: []string{"user"},
+		},
+	}
+}
+
+func TestUsers(t *testing.T) {
+	assert := require.New(t)
+
+	unchanged := createTestUser("1", "one@email.com")
+	removed := createTestUser("2", "two@email.com")
+	modified := createTestUser("3", "three@email.com")
+	deleted := createTestUser("4", "four@email.com")
+	added := createTestUser("5", "five@email.com")
+
+	modifiedAfter := proto.Clone(modified).(*api.User)
+	modifiedAfter.Identities["three"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_USERNAME}
+	modifiedAfter.Attributes.Roles = []string{"user", "admin"}
+	modifiedAfter.Attributes.Properties.Fields["department"] = structpb.NewStringValue("support/eng")
+	deletedAfter := proto.Clone(deleted).(*api.User)
+	deletedAfter.Deleted = true
+
+	report, err := Users(
+		[]*api.User{unchanged, removed, modified, deleted},
+		[]*api.User{unchanged, modifiedAfter, deletedAfter, added},
+	)
+	assert.Nil(err)
+
+	assert.Equal(Summary{Added: 1, Removed: 1, Deleted: 1, Modified: 1}, report.Summary)
+	assert.Equal(4, len(report.Changes))
+
+	assert.Equal(Removed, report.Changes[0].Change)
+	assert.Equal("2", report.Changes[0].ID)
+
+	assert.Equal(Modified, report.Changes[1].Change)
+	assert.Equal([]*Operation{
+		{Op: OpReplace, Path: "/attributes/properties/department", Value: "support/eng"},
+		{Op: OpReplace, Path: "/attributes/roles", Value: []interface{}{"user", "admin"}},
+		{Op: OpAdd, Path: "/identities/three", Value: map[string]interface{}{"kind": "IDENTITY_KIND_USERNAME"}},
+	}, report.Changes[1].Patch)
+
+	assert.Equal(Deleted, report.Changes[2].Change)
+	assert.Equal([]*Operation{{Op: OpAdd, Path: "/deleted", Value: true}}, report.Changes[2].Patch)
+
+	assert.Equal(Added, report.Changes[3].Change)
+	assert.Equal("five@email.com", report.Changes[3].User["email"])
+
+	var buf bytes.Buffer
+	assert.Nil(report.WriteSummary(&buf))
+	assert.Contains(buf.String(), "1 added, 1 removed, 1 deleted, 0 restored, 1 modified\n")
+	assert.Contains(buf.String(), "modified 3\n  replace /attributes/properties/department \"support/eng\"\n")
+}
+
+func TestPointer(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("/identities/auth0|1/kind", pointer([]string{"identities", "auth0|1", "kind"}))
+	assert.Equal("/a~1b/c~0d", pointer([]string{"a/b", "c~d"}))
+}
+
+func TestUsersDuplicateID(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := Users([]*api.User{createTestUser("1", "a@email.com"), createTestUser("1", "b@email.com")}, nil)
+	assert.NotNil(err)
+	assert.Equal("duplicate user id '1'", err.Error())
+}
@@ -0,0 +1,186 @@
+package diff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// LoadChanges reads a change-set file, either a report written by the diff
+// command or a bare array of changes.
+func LoadChanges(file string) ([]*Change, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*Change
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "[") {
+		err = json.Unmarshal(content, &changes)
+	} else {
+		report := &Report{}
+		err = json.Unmarshal(content, report)
+		changes = report.Changes
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid change-set '%s': %w", file, err)
+	}
+
+	seen := map[string]bool{}
+	for _, change := range changes {
+		switch change.Change {
+		case Added:
+			if change.User == nil {
+				return nil, fmt.Errorf("added user '%s' has no user", change.ID)
+			}
+		case Removed, Deleted, Restored, Modified:
+		default:
+			return nil, fmt.Errorf("unknown change '%s' of user '%s'", change.Change, change.ID)
+		}
+		if seen[change.ID] {
+			return nil, fmt.Errorf("user '%s' is changed more than once", change.ID)
+		}
+		seen[change.ID] = true
+	}
+
+	return changes, nil
+}
+
+// NewUser returns the user of an added change.
+func (c *Change) NewUser() (*api.User, error) {
+	b, err := json.Marshal(c.User)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &api.User{}
+	if err := protojson.Unmarshal(b, user); err != nil {
+		return nil, err
+	}
+	if user.Id == "" {
+		user.Id = c.ID
+	}
+	if user.Id != c.ID {
+		return nil, fmt.Errorf("added user '%s' has id '%s'", c.ID, user.Id)
+	}
+
+	return user, nil
+}
+
+// Patch returns user with the JSON Patch operations applied.
+func Patch(user *api.User, ops []*Operation) (*api.User, error) {
+	b, err := jsonOptions.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		if doc, err = apply(doc, op); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+
+	if b, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	patched := &api.User{}
+	if err := protojson.Unmarshal(b, patched); err != nil {
+		return nil, err
+	}
+	if patched.Id != user.Id {
+		return nil, errors.New("the patch cannot change the id")
+	}
+
+	return patched, nil
+}
+
+func apply(doc interface{}, op *Operation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return nil, errors.New("the whole user cannot be patched")
+	}
+
+	parent := doc
+	for _, segment := range path[:len(path)-1] {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			child, ok := node[segment]
+			if !ok {
+				// missing objects are created by add and replace, like empty
+				// attributes omitted from the written user
+				if op.Op == OpRemove {
+					return nil, errors.New("path not found")
+				}
+				child = map[string]interface{}{}
+				node[segment] = child
+			}
+			parent = child
+		case []interface{}:
+			i, err := arrayIndex(segment, len(node))
+			if err != nil {
+				return nil, err
+			}
+			parent = node[i]
+		default:
+			return nil, errors.New("path not found")
+		}
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if op.Op == OpRemove {
+			if _, ok := node[last]; !ok {
+				return nil, errors.New("path not found")
+			}
+			delete(node, last)
+			return doc, nil
+		}
+		if op.Op != OpAdd && op.Op != OpReplace {
+			return nil, fmt.Errorf("unsupported operation '%s'", op.Op)
+		}
+		node[last] = op.Value
+		return doc, nil
+	case []interface{}:
+		return nil, errors.New("array elements cannot be patched, replace the array")
+	default:
+		return nil, errors.New("path not found")
+	}
+}
+
+func arrayIndex(segment string, length int) (int, error) {
+	i, err := strconv.Atoi(segment)
+	if err != nil || i < 0 || i >= length {
+		return 0, fmt.Errorf("invalid array index '%s'", segment)
+	}
+	return i, nil
+}
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped segments.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid path '%s'", p)
+	}
+
+	segments := strings.Split(p[1:], "/")
+	for i, segment := range segments {
+		segments[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+	}
+	return segments, nil
+}
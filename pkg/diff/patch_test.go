@@ -0,0 +1,67 @@
+package diff
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestPatchRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	before := createTestUser("1", "one@email.com")
+	after := proto.Clone(before).(*api.User)
+	after.Email = "first@email.com"
+	after.Identities["first@email.com"] = after.Identities["one@email.com"]
+	delete(after.Identities, "one@email.com")
+	after.Attributes.Roles = []string{"admin"}
+	after.Attributes.Properties.Fields["title"] = structpb.NewStringValue("Lead")
+	delete(after.Attributes.Properties.Fields, "department")
+
+	report, err := Users([]*api.User{before}, []*api.User{after})
+	assert.Nil(err)
+	assert.Equal(1, len(report.Changes))
+
+	patched, err := Patch(before, report.Changes[0].Patch)
+	assert.Nil(err)
+	assert.True(proto.Equal(after, patched))
+}
+
+func TestPatchErrors(t *testing.T) {
+	assert := require.New(t)
+
+	user := createTestUser("1", "one@email.com")
+
+	_, err := Patch(user, []*Operation{{Op: OpRemove, Path: "/attributes/properties/title"}})
+	assert.NotNil(err)
+	assert.Equal("remove /attributes/properties/title: path not found", err.Error())
+
+	_, err = Patch(user, []*Operation{{Op: OpReplace, Path: "/id", Value: "2"}})
+	assert.NotNil(err)
+	assert.Equal("the patch cannot change the id", err.Error())
+
+	_, err = Patch(user, []*Operation{{Op: OpReplace, Path: "/attributes/roles/0", Value: "admin"}})
+	assert.NotNil(err)
+}
+
+func TestLoadChanges(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.json")
+	assert.Nil(os.WriteFile(report, []byte(`{"summary": {}, "changes": [{"id": "1", "change": "removed"}]}`), 0600))
+	changes, err := LoadChanges(report)
+	assert.Nil(err)
+	assert.Equal(1, len(changes))
+
+	bare := filepath.Join(dir, "changes.json")
+	assert.Nil(os.WriteFile(bare, []byte(`[{"id": "1", "change": "deleted"}, {"id": "1", "change": "restored"}]`), 0600))
+	_, err = LoadChanges(bare)
+	assert.NotNil(err)
+	assert.Equal("user '1' is changed more than once", err.Error())
+}
@@ -0,0 +1,165 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// header is the first line of every age encrypted file.
+const header = "age-encryption.org/v1\n"
+
+var ErrNoKey = errors.New("file is encrypted but no decryption key is configured")
+
+// Keys holds the age recipients used to encrypt and the identities used to decrypt.
+type Keys struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// Load builds the keys from the passphrase held by the passphraseEnv environment
+// variable, or from an age recipients file and an age identity file. It returns
+// nil when no key is configured.
+func Load(passphraseEnv, recipientsFile, identityFile string) (*Keys, error) {
+	if passphraseEnv == "" && recipientsFile == "" && identityFile == "" {
+		return nil, nil
+	}
+
+	keys := &Keys{}
+
+	if passphraseEnv != "" {
+		if recipientsFile != "" || identityFile != "" {
+			return nil, errors.New("a passphrase cannot be combined with age recipients or identities")
+		}
+
+		passphrase := os.Getenv(passphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("environment variable '%s' is empty", passphraseEnv)
+		}
+
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys.recipients = []age.Recipient{recipient}
+		keys.identities = []age.Identity{identity}
+
+		return keys, nil
+	}
+
+	if recipientsFile != "" {
+		f, err := os.Open(recipientsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		keys.recipients, err = age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipients file '%s': %w", recipientsFile, err)
+		}
+	}
+
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		keys.identities, err = age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file '%s': %w", identityFile, err)
+		}
+
+		// files rewritten by delete are encrypted to the owner of the identity
+		if recipientsFile == "" {
+			for _, identity := range keys.identities {
+				if x, ok := identity.(*age.X25519Identity); ok {
+					keys.recipients = append(keys.recipients, x.Recipient())
+				}
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// Ephemeral returns keys of a new X25519 identity, used to encrypt temporary
+// files that do not outlive the process.
+func Ephemeral() (*Keys, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keys{
+		recipients: []age.Recipient{identity.Recipient()},
+		identities: []age.Identity{identity},
+	}, nil
+}
+
+// CanEncrypt reports whether keys hold at least one recipient.
+func (k *Keys) CanEncrypt() bool {
+	return k != nil && len(k.recipients) > 0
+}
+
+// Encrypt returns a writer encrypting to w, the caller must close it to flush
+// the last chunk.
+func (k *Keys) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if !k.CanEncrypt() {
+		return nil, errors.New("no encryption recipient is configured")
+	}
+	return age.Encrypt(w, k.recipients...)
+}
+
+// Reader returns a reader of the plaintext of r, decrypting it when it is age
+// encrypted. Plaintext input is returned unchanged.
+func (k *Keys) Reader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	peek, err := br.Peek(len(header))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(peek, []byte(header)) {
+		return br, nil
+	}
+
+	if k == nil || len(k.identities) == 0 {
+		return nil, ErrNoKey
+	}
+
+	plain, err := age.Decrypt(br, k.identities...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt, wrong key or corrupted file: %w", err)
+	}
+
+	return plain, nil
+}
+
+// IsEncrypted reports whether the file starts with the age header.
+func IsEncrypted(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(header))
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+
+	return bytes.Equal(buf[:n], []byte(header)), nil
+}
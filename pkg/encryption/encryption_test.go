@@ -0,0 +1,131 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func encrypt(keys *Keys, plain string) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	w, err := keys.Encrypt(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, plain); err != nil {
+		return nil, err
+	}
+	return &buf, w.Close()
+}
+
+func TestLoadWithoutKeys(t *testing.T) {
+	assert := require.New(t)
+
+	keys, err := Load("", "", "")
+	assert.Nil(err)
+	assert.Nil(keys)
+	assert.False(keys.CanEncrypt())
+
+	r, err := keys.Reader(strings.NewReader("[]"))
+	assert.Nil(err)
+	b, err := io.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal("[]", string(b))
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_PASSPHRASE", "correct horse battery staple")
+	keys, err := Load("TEST_JSON_PASSPHRASE", "", "")
+	assert.Nil(err)
+	assert.True(keys.CanEncrypt())
+
+	buf, err := encrypt(keys, `[{"id":"1"}]`)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(buf.String(), "age-encryption.org/v1\n"))
+
+	r, err := keys.Reader(buf)
+	assert.Nil(err)
+	b, err := io.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal(`[{"id":"1"}]`, string(b))
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_PASSPHRASE", "correct horse battery staple")
+	keys, err := Load("TEST_JSON_PASSPHRASE", "", "")
+	assert.Nil(err)
+
+	buf, err := encrypt(keys, `[]`)
+	assert.Nil(err)
+
+	t.Setenv("TEST_JSON_PASSPHRASE", "wrong")
+	keys, err = Load("TEST_JSON_PASSPHRASE", "", "")
+	assert.Nil(err)
+
+	_, err = keys.Reader(buf)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "cannot decrypt, wrong key or corrupted file")
+}
+
+func TestEncryptedWithoutKey(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_PASSPHRASE", "correct horse battery staple")
+	keys, err := Load("TEST_JSON_PASSPHRASE", "", "")
+	assert.Nil(err)
+
+	buf, err := encrypt(keys, `[]`)
+	assert.Nil(err)
+
+	var none *Keys
+	_, err = none.Reader(buf)
+	assert.Equal(ErrNoKey, err)
+}
+
+func TestEmptyPassphraseEnv(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := Load("TEST_JSON_PASSPHRASE_UNSET", "", "")
+	assert.NotNil(err)
+	assert.Equal("environment variable 'TEST_JSON_PASSPHRASE_UNSET' is empty", err.Error())
+}
+
+func TestIdentityFileRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(err)
+
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "key.txt")
+	err = os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	assert.Nil(err)
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	err = os.WriteFile(recipientsFile, []byte(identity.Recipient().String()+"\n"), 0600)
+	assert.Nil(err)
+
+	writer, err := Load("", recipientsFile, "")
+	assert.Nil(err)
+	buf, err := encrypt(writer, "secret")
+	assert.Nil(err)
+
+	reader, err := Load("", "", identityFile)
+	assert.Nil(err)
+	assert.True(reader.CanEncrypt(), "the identity recipient is used to re-encrypt")
+
+	r, err := reader.Reader(buf)
+	assert.Nil(err)
+	b, err := io.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal("secret", string(b))
+}
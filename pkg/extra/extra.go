@@ -0,0 +1,135 @@
+// Package extra keeps the JSON fields of a record that its protobuf message does
+// not declare, so that they survive a rewrite of the record.
+package extra
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Fields holds the unknown fields of a JSON object by key. Values are either the
+// raw JSON of an unknown field or the Fields of a known nested object.
+type Fields map[string]interface{}
+
+// Unmarshal unmarshals record into m ignoring unknown fields, which it returns,
+// nil when the record has none.
+func Unmarshal(record []byte, m proto.Message) (Fields, error) {
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(record, m); err != nil {
+		return nil, err
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(record, &object); err != nil {
+		return nil, err
+	}
+
+	return split(object, m.ProtoReflect().Descriptor()), nil
+}
+
+func split(object map[string]json.RawMessage, md protoreflect.MessageDescriptor) Fields {
+	var fields Fields
+	add := func(key string, value interface{}) {
+		if fields == nil {
+			fields = Fields{}
+		}
+		fields[key] = value
+	}
+
+	for key, value := range object {
+		fd := md.Fields().ByJSONName(key)
+		if fd == nil {
+			fd = md.Fields().ByName(protoreflect.Name(key))
+		}
+		if fd == nil {
+			add(key, value)
+			continue
+		}
+
+		// written records use the proto names of the fields
+		name := string(fd.Name())
+
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Kind() != protoreflect.MessageKind || wellKnown(fd.MapValue().Message()) {
+				continue
+			}
+			var entries map[string]map[string]json.RawMessage
+			if err := json.Unmarshal(value, &entries); err != nil {
+				continue
+			}
+			nested := Fields{}
+			for entryKey, entry := range entries {
+				if f := split(entry, fd.MapValue().Message()); f != nil {
+					nested[entryKey] = f
+				}
+			}
+			if len(nested) > 0 {
+				add(name, nested)
+			}
+
+		case fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !wellKnown(fd.Message()):
+			var nested map[string]json.RawMessage
+			if err := json.Unmarshal(value, &nested); err != nil {
+				continue
+			}
+			if f := split(nested, fd.Message()); f != nil {
+				add(name, f)
+			}
+		}
+	}
+
+	return fields
+}
+
+// wellKnown reports whether md is a google.protobuf type, which have their own
+// JSON mapping and no unknown fields.
+func wellKnown(md protoreflect.MessageDescriptor) bool {
+	return strings.HasPrefix(string(md.FullName()), "google.protobuf.")
+}
+
+// Merge adds fields to the JSON object record. Objects missing from record, such
+// as the identity of a renamed key, are not created.
+func Merge(record []byte, fields Fields, indent string) ([]byte, error) {
+	if len(fields) == 0 {
+		return record, nil
+	}
+
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	merge(object, fields)
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(object); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func merge(object map[string]interface{}, fields Fields) {
+	for key, value := range fields {
+		nested, ok := value.(Fields)
+		if !ok {
+			if _, exists := object[key]; !exists {
+				object[key] = value
+			}
+			continue
+		}
+		if o, ok := object[key].(map[string]interface{}); ok {
+			merge(o, nested)
+		}
+	}
+}
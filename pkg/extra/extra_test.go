@@ -0,0 +1,69 @@
+package extra
+
+import (
+	"encoding/json"
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const record = `{
+	"id": "1",
+	"displayName": "Test Name",
+	"x_source": {"tool": "hr", "version": 3},
+	"identities": {
+		"test@email.com": {"kind": "IDENTITY_KIND_EMAIL", "x_primary": true}
+	},
+	"attributes": {
+		"properties": {"department": "sales"},
+		"x_cost_center": "1234"
+	},
+	"metadata": {"created_at": "2021-01-01T00:00:00Z", "x_origin": "import"}
+}`
+
+func TestUnmarshal(t *testing.T) {
+	assert := require.New(t)
+
+	user := &api.User{}
+	fields, err := Unmarshal([]byte(record), user)
+	assert.Nil(err)
+	assert.Equal("Test Name", user.DisplayName)
+
+	assert.Equal(json.RawMessage(`{"tool": "hr", "version": 3}`), fields["x_source"])
+	assert.Equal(json.RawMessage(`true`), fields["identities"].(Fields)["test@email.com"].(Fields)["x_primary"])
+	assert.Equal(json.RawMessage(`"1234"`), fields["attributes"].(Fields)["x_cost_center"])
+	assert.Equal(json.RawMessage(`"import"`), fields["metadata"].(Fields)["x_origin"])
+	assert.Equal(4, len(fields))
+
+	fields, err = Unmarshal([]byte(`{"id": "2", "display_name": "Known"}`), &api.User{})
+	assert.Nil(err)
+	assert.Nil(fields)
+}
+
+func TestMerge(t *testing.T) {
+	assert := require.New(t)
+
+	user := &api.User{}
+	fields, err := Unmarshal([]byte(record), user)
+	assert.Nil(err)
+
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(user)
+	assert.Nil(err)
+
+	merged, err := Merge(b, fields, "  ")
+	assert.Nil(err)
+
+	var doc map[string]interface{}
+	assert.Nil(json.Unmarshal(merged, &doc))
+	assert.Equal("Test Name", doc["display_name"])
+	assert.Equal(map[string]interface{}{"tool": "hr", "version": float64(3)}, doc["x_source"])
+	assert.Equal(true, doc["identities"].(map[string]interface{})["test@email.com"].(map[string]interface{})["x_primary"])
+	assert.Equal("1234", doc["attributes"].(map[string]interface{})["x_cost_center"])
+	assert.Equal("import", doc["metadata"].(map[string]interface{})["x_origin"])
+
+	unchanged, err := Merge(b, nil, "  ")
+	assert.Nil(err)
+	assert.Equal(b, unchanged)
+}
@@ -0,0 +1,69 @@
+// Package filelock serializes the processes rewriting a file with an advisory
+// lock. The lock is held on a companion file, name.lock, rather than on the file
+// itself, which is replaced by every rewrite.
+package filelock
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// retryInterval is the time waited between two attempts to take a held lock.
+const retryInterval = 50 * time.Millisecond
+
+// ErrLocked is returned when the lock is still held by another process once the
+// timeout elapsed.
+var ErrLocked = errors.New("the lock is held by another process")
+
+// Lock is an exclusive advisory lock on a file.
+type Lock struct {
+	file *os.File
+}
+
+// File returns the name of the companion file the lock of name is held on.
+func File(name string) string {
+	return name + ".lock"
+}
+
+// Acquire takes the lock of name, waiting up to timeout for another holder to
+// release it.
+func Acquire(name string, timeout time.Duration) (*Lock, error) {
+	file, err := os.OpenFile(File(name), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			return &Lock{file: file}, nil
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, ErrLocked
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// Release releases the lock. The companion file is left in place, removing it
+// would let two processes lock different files.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	err := unlock(l.file)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+
+	return err
+}
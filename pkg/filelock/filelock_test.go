@@ -0,0 +1,46 @@
+package filelock
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireHeldLock(t *testing.T) {
+	assert := require.New(t)
+
+	name := filepath.Join(t.TempDir(), "users.json")
+
+	lock, err := Acquire(name, 0)
+	assert.Nil(err)
+
+	start := time.Now()
+	_, err = Acquire(name, 200*time.Millisecond)
+	assert.ErrorIs(err, ErrLocked)
+	assert.GreaterOrEqual(time.Since(start), 200*time.Millisecond)
+
+	assert.Nil(lock.Release())
+
+	lock, err = Acquire(name, 0)
+	assert.Nil(err)
+	assert.Nil(lock.Release())
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	assert := require.New(t)
+
+	name := filepath.Join(t.TempDir(), "users.json")
+
+	lock, err := Acquire(name, 0)
+	assert.Nil(err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Release() // nolint:errcheck // checked by the second acquire
+	}()
+
+	second, err := Acquire(name, 5*time.Second)
+	assert.Nil(err)
+	assert.Nil(second.Release())
+}
@@ -0,0 +1,172 @@
+// Package filter selects users by the values of their fields.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/jsonpath"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// unset fields are emitted with their zero value, so that deleted=false matches
+// users that are not deleted, see also fillOptional
+var jsonOptions = protojson.MarshalOptions{ // nolint:gochecknoglobals // constant
+	UseProtoNames:   true,
+	EmitUnpopulated: true,
+}
+
+type term struct {
+	path    []string
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+// Filter is a conjunction of conditions on user fields.
+type Filter struct {
+	terms []term
+}
+
+// Parse parses expr, a comma separated list of field=value and field!=value
+// conditions that must all hold, such as "enabled=false,email=*@contractor.com".
+// Fields are dotted paths of the user as written, with "*" matching every key of
+// a map, and "*" in a value matches any run of characters. A condition holds when
+// any of the values of a field, such as any of its roles, equals the value. Unset
+// fields, optional ones included, have their zero value, such as false or "", and
+// missing ones the empty value.
+func Parse(expr string) (*Filter, error) {
+	f := &Filter{}
+
+	for _, condition := range strings.Split(expr, ",") {
+		if strings.TrimSpace(condition) == "" {
+			continue
+		}
+		parts := strings.SplitN(condition, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid condition '%s'", condition)
+		}
+
+		field, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		negate := strings.HasSuffix(field, "!")
+		field = strings.TrimSpace(strings.TrimSuffix(field, "!"))
+		if field == "" {
+			return nil, fmt.Errorf("invalid condition '%s'", condition)
+		}
+
+		path, err := jsonpath.Parse(field)
+		if err != nil {
+			return nil, err
+		}
+
+		quoted := strings.Split(value, "*")
+		for i, s := range quoted {
+			quoted[i] = regexp.QuoteMeta(s)
+		}
+		pattern := regexp.MustCompile("^" + strings.Join(quoted, ".*") + "$")
+
+		f.terms = append(f.terms, term{path: path, pattern: pattern, negate: negate})
+	}
+	if len(f.terms) == 0 {
+		return nil, fmt.Errorf("invalid filter '%s'", expr)
+	}
+
+	return f, nil
+}
+
+// Match reports whether user satisfies every condition of the filter.
+func (f *Filter) Match(user *api.User) (bool, error) {
+	filled := proto.Clone(user).(*api.User)
+	fillOptional(filled.ProtoReflect())
+
+	b, err := jsonOptions.Marshal(filled)
+	if err != nil {
+		return false, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return false, err
+	}
+
+	for _, t := range f.terms {
+		values := lookup(doc, t.path)
+		if len(values) == 0 {
+			values = []string{""}
+		}
+
+		found := false
+		for _, v := range values {
+			if t.pattern.MatchString(v) {
+				found = true
+				break
+			}
+		}
+		if found == t.negate {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// fillOptional sets the unset optional scalar fields of m, and of the messages
+// it holds, to their zero value, which is not emitted for them otherwise. This
+// way enabled=false matches the users whose enabled field is unset.
+func fillOptional(m protoreflect.Message) {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		switch {
+		case fd.IsList() || fd.IsMap():
+		case fd.Message() != nil:
+			if m.Has(fd) {
+				fillOptional(m.Mutable(fd).Message())
+			}
+		case fd.HasOptionalKeyword() && !m.Has(fd):
+			m.Set(fd, fd.Default())
+		}
+	}
+}
+
+// lookup returns the values found at path of node.
+func lookup(node interface{}, path []string) []string {
+	if arr, ok := node.([]interface{}); ok {
+		var values []string
+		for _, item := range arr {
+			values = append(values, lookup(item, path)...)
+		}
+		return values
+	}
+
+	if len(path) == 0 {
+		switch v := node.(type) {
+		case nil:
+			return nil
+		case string:
+			return []string{v}
+		case map[string]interface{}:
+			return nil
+		default:
+			return []string{fmt.Sprint(v)}
+		}
+	}
+
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if path[0] != "*" {
+		return lookup(obj[path[0]], path[1:])
+	}
+
+	var values []string
+	for _, child := range obj {
+		values = append(values, lookup(child, path[1:])...)
+	}
+	return values
+}
@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func createTestUser(id, email, department string, roles ...string) *api.User {
+	return &api.User{
+		Id:      id,
+		Email:   email,
+		Enabled: proto.Bool(true),
+		Attributes: &api.AttrSet{
+			Properties: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"department": structpb.NewStringValue(department),
+			}},
+			Roles: roles,
+		},
+		Applications: map[string]*api.AttrSet{
+			"peoplefinder": {Roles: []string{"viewer"}},
+		},
+	}
+}
+
+func TestMatch(t *testing.T) {
+	assert := require.New(t)
+
+	euan := createTestUser("1", "euang@acmecorp.com", "Sales", "admin", "user")
+	april := createTestUser("2", "aprils@contractor.com", "Sales Engineering", "user")
+	april.Enabled = proto.Bool(false)
+
+	tests := []struct {
+		expr  string
+		euan  bool
+		april bool
+	}{
+		{"id=1", true, false},
+		{"email=*@contractor.com", false, true},
+		{"attributes.properties.department=Sales", true, false},
+		{"attributes.properties.department=Sales*", true, true},
+		{"attributes.roles=admin", true, false},
+		{"attributes.roles!=admin", false, true},
+		{"enabled=false", false, true},
+		{"deleted=false", true, true},
+		{"deleted=false, email=*@contractor.com", false, true},
+		{"deleted=true", false, false},
+		{"enabled=true, attributes.roles=user", true, false},
+		{"applications.*.roles=viewer", true, true},
+		{"picture=", true, true},
+	}
+	for _, test := range tests {
+		f, err := Parse(test.expr)
+		assert.Nil(err, test.expr)
+
+		matched, err := f.Match(euan)
+		assert.Nil(err)
+		assert.Equal(test.euan, matched, test.expr)
+
+		matched, err = f.Match(april)
+		assert.Nil(err)
+		assert.Equal(test.april, matched, test.expr)
+	}
+}
+
+func TestMatchUnsetEnabled(t *testing.T) {
+	assert := require.New(t)
+
+	user := createTestUser("1", "euang@acmecorp.com", "Sales")
+	user.Enabled = nil
+
+	// an unset optional field has its zero value, like the other fields
+	for expr, expected := range map[string]bool{
+		"enabled=false": true,
+		"enabled=true":  false,
+		"enabled=":      false,
+	} {
+		f, err := Parse(expr)
+		assert.Nil(err)
+		matched, err := f.Match(user)
+		assert.Nil(err)
+		assert.Equal(expected, matched, expr)
+	}
+	assert.Nil(user.Enabled, "the matched user should not be modified")
+}
+
+func TestParseInvalid(t *testing.T) {
+	assert := require.New(t)
+
+	for _, expr := range []string{"", "email", "=x", "attributes..roles=x"} {
+		_, err := Parse(expr)
+		assert.NotNil(err, expr)
+	}
+}
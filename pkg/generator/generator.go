@@ -0,0 +1,185 @@
+package generator
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultDomain   = "acmecorp.com"
+	defaultProvider = "auth0"
+	picturesURL     = "https://github.com/aserto-demo/contoso-ad-sample/raw/main/UserImages/"
+)
+
+var (
+	firstNames = []string{ // nolint:gochecknoglobals // sample data
+		"Euan", "Chris", "April", "Beth", "Dan", "Ewan", "Fatima", "Gilles", "Hana", "Ivan",
+		"Jun", "Kofi", "Lena", "Miriam", "Nestor", "Olga", "Priya", "Quinn", "Rosa", "Sanjay",
+	}
+	lastNames = []string{ // nolint:gochecknoglobals // sample data
+		"Garden", "Johnson", "Stewart", "Adams", "Bell", "Castro", "Dubois", "Eriksen", "Fischer", "Gupta",
+		"Haddad", "Ito", "Jensen", "Kowalski", "Lopez", "Moreau", "Novak", "Okafor", "Petrov", "Silva",
+	}
+	departments = []string{ // nolint:gochecknoglobals // sample data
+		"Sales Engagement Management", "Engineering", "Marketing", "Finance", "Human Resources", "Operations", "Support",
+	}
+	titles = []string{ // nolint:gochecknoglobals // sample data
+		"Salesperson", "Engineer", "Manager", "Analyst", "Director", "Specialist", "Coordinator",
+	}
+	applications = []string{"peoplefinder", "todo", "expenses"} // nolint:gochecknoglobals // sample data
+	appRoles     = []string{"viewer", "editor", "admin"}        // nolint:gochecknoglobals // sample data
+)
+
+// Options controls the generated users. Equal options always generate equal users.
+type Options struct {
+	Count        int
+	Seed         int64
+	DeletedRatio float64
+	Domain       string
+	Provider     string
+	// Epoch is the earliest creation time, timestamps are spread over the following year
+	Epoch time.Time
+}
+
+// Generate produces opts.Count users and passes them to fn in order. Every user
+// has an identity of each identity kind, roles, applications and, except for the
+// first one, a manager generated before it so that managers form a tree.
+func Generate(opts Options, fn func(*api.User) error) error {
+	if opts.Domain == "" {
+		opts.Domain = defaultDomain
+	}
+	if opts.Provider == "" {
+		opts.Provider = defaultProvider
+	}
+	if opts.Epoch.IsZero() {
+		opts.Epoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed)) // nolint:gosec // deterministic test data
+	ids := make([]string, 0, opts.Count)
+
+	for i := 0; i < opts.Count; i++ {
+		id := uuid(rng)
+		ids = append(ids, id)
+
+		manager := ""
+		if i > 0 {
+			manager = ids[rng.Intn(i)]
+		}
+
+		if err := fn(newUser(rng, &opts, i, id, manager)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Users returns the generated users as a slice.
+func Users(opts Options) []*api.User {
+	users := make([]*api.User, 0, opts.Count)
+	_ = Generate(opts, func(u *api.User) error {
+		users = append(users, u)
+		return nil
+	})
+	return users
+}
+
+func newUser(rng *rand.Rand, opts *Options, i int, id, manager string) *api.User {
+	first := firstNames[rng.Intn(len(firstNames))]
+	last := lastNames[rng.Intn(len(lastNames))]
+	username := fmt.Sprintf("%s%s%d", strings.ToLower(first), strings.ToLower(last[:1]), i)
+	email := username + "@" + opts.Domain
+	phone := fmt.Sprintf("+1-%03d-555-%04d", 200+rng.Intn(800), rng.Intn(10000))
+	department := departments[rng.Intn(len(departments))]
+	title := titles[rng.Intn(len(titles))]
+	enabled := rng.Intn(10) != 0
+
+	properties := map[string]*structpb.Value{
+		"department": structpb.NewStringValue(department),
+		"title":      structpb.NewStringValue(title),
+		"phone":      structpb.NewStringValue(phone),
+	}
+	if manager != "" {
+		properties["manager"] = structpb.NewStringValue(manager)
+	}
+
+	user := &api.User{
+		Id:          id,
+		Enabled:     &enabled,
+		DisplayName: first + " " + last,
+		Email:       email,
+		Picture:     picturesURL + first + "%20" + last + ".jpg",
+		Identities: map[string]*api.IdentitySource{
+			opts.Provider + "|" + id:              {Kind: api.IdentityKind_IDENTITY_KIND_PID, Provider: opts.Provider, Verified: true},
+			email:                                 {Kind: api.IdentityKind_IDENTITY_KIND_EMAIL, Provider: opts.Provider, Verified: rng.Intn(4) != 0},
+			username:                              {Kind: api.IdentityKind_IDENTITY_KIND_USERNAME},
+			phone:                                 {Kind: api.IdentityKind_IDENTITY_KIND_PHONE},
+			dn(username, department, opts.Domain): {Kind: api.IdentityKind_IDENTITY_KIND_DN, Provider: "ldap"},
+		},
+		Attributes: &api.AttrSet{
+			Properties:  &structpb.Struct{Fields: properties},
+			Roles:       []string{"user", strings.Split(opts.Domain, ".")[0], slug(department)},
+			Permissions: []string{},
+		},
+		Applications: map[string]*api.AttrSet{},
+		Metadata:     &api.Metadata{},
+	}
+	if i == 0 || rng.Intn(20) == 0 {
+		user.Attributes.Roles = append(user.Attributes.Roles, "admin")
+	}
+
+	for _, app := range applications {
+		if rng.Intn(2) == 0 {
+			continue
+		}
+		user.Applications[app] = &api.AttrSet{
+			Properties: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"department": structpb.NewStringValue(department),
+				"title":      structpb.NewStringValue(title),
+			}},
+			Roles:       []string{appRoles[rng.Intn(len(appRoles))]},
+			Permissions: []string{},
+		}
+	}
+
+	year := int64(365 * 24 * time.Hour)
+	created := opts.Epoch.Add(time.Duration(rng.Int63n(year)))
+	updated := created.Add(time.Duration(rng.Int63n(year)))
+	user.Metadata.CreatedAt = timestamppb.New(created)
+	user.Metadata.UpdatedAt = timestamppb.New(updated)
+
+	if rng.Float64() < opts.DeletedRatio {
+		user.Deleted = true
+		user.Metadata.DeletedAt = timestamppb.New(updated.Add(time.Duration(rng.Int63n(year / 12))))
+	}
+
+	return user
+}
+
+// uuid returns a random version 4 UUID drawn from rng.
+func uuid(rng *rand.Rand) string {
+	b := make([]byte, 16)
+	_, _ = rng.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func dn(username, department, domain string) string {
+	parts := []string{"uid=" + username, "ou=" + department}
+	for _, dc := range strings.Split(domain, ".") {
+		parts = append(parts, "dc="+dc)
+	}
+	return strings.Join(parts, ",")
+}
+
+func slug(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), " ", "-")
+}
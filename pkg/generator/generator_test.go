@@ -0,0 +1,54 @@
+package generator
+
+import (
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	assert := require.New(t)
+
+	first := Users(Options{Count: 20, Seed: 42, DeletedRatio: 0.2})
+	second := Users(Options{Count: 20, Seed: 42, DeletedRatio: 0.2})
+	other := Users(Options{Count: 20, Seed: 7, DeletedRatio: 0.2})
+
+	assert.Equal(20, len(first))
+	for i := range first {
+		assert.True(proto.Equal(first[i], second[i]))
+	}
+	assert.NotEqual(first[0].Id, other[0].Id)
+}
+
+func TestGenerateIdentitiesAndManagers(t *testing.T) {
+	assert := require.New(t)
+
+	users := Users(Options{Count: 50, Seed: 1, DeletedRatio: 0.5})
+
+	seen := map[string]bool{}
+	deleted := 0
+	for i, user := range users {
+		kinds := map[api.IdentityKind]bool{}
+		for _, identity := range user.Identities {
+			kinds[identity.Kind] = true
+		}
+		assert.Equal(5, len(kinds), "every identity kind should be generated")
+
+		manager := user.Attributes.Properties.Fields["manager"].GetStringValue()
+		if i == 0 {
+			assert.Equal("", manager)
+		} else {
+			assert.True(seen[manager], "the manager should be generated before the user")
+		}
+		seen[user.Id] = true
+
+		if user.Deleted {
+			deleted++
+			assert.NotNil(user.Metadata.DeletedAt)
+		}
+	}
+	assert.True(deleted > 0)
+	assert.True(deleted < len(users))
+}
@@ -0,0 +1,201 @@
+package jsonpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// placeholder marks the position of the users array while rendering a template.
+const placeholder = "\x00users\x00"
+
+// Parse splits a dotted path ("data.users") or a JSON pointer ("/data/users")
+// into its segments. An empty path yields no segments.
+func Parse(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(path, "/") {
+		segments := strings.Split(path[1:], "/")
+		for i, s := range segments {
+			segments[i] = strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+		}
+		return segments, nil
+	}
+
+	segments := strings.Split(path, ".")
+	for _, s := range segments {
+		if s == "" {
+			return nil, fmt.Errorf("invalid path '%s'", path)
+		}
+	}
+	return segments, nil
+}
+
+// Seek consumes the decoder input up to and including the opening delimiter of
+// the array found at path, skipping every other value without buffering it.
+func Seek(decoder *json.Decoder, path []string) error {
+	for i, segment := range path {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t {
+		case json.Delim('{'):
+			err = seekKey(decoder, segment)
+		case json.Delim('['):
+			err = seekIndex(decoder, segment)
+		default:
+			err = fmt.Errorf("%s is not an object or an array", describe(path[:i]))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	t, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("%s is not an array", describe(path))
+	}
+
+	return nil
+}
+
+// describe names the value at path in errors.
+func describe(path []string) string {
+	if len(path) == 0 {
+		return "the top-level value"
+	}
+	return "'" + strings.Join(path, ".") + "'"
+}
+
+func seekKey(decoder *json.Decoder, key string) error {
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if t == key {
+			return nil
+		}
+		if err := skip(decoder); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("'%s' not found", key)
+}
+
+func seekIndex(decoder *json.Decoder, segment string) error {
+	index, err := strconv.Atoi(segment)
+	if err != nil {
+		return fmt.Errorf("'%s' is not an array index", segment)
+	}
+	for i := 0; i < index; i++ {
+		if !decoder.More() {
+			return fmt.Errorf("index %d out of range", index)
+		}
+		if err := skip(decoder); err != nil {
+			return err
+		}
+	}
+	if !decoder.More() {
+		return fmt.Errorf("index %d out of range", index)
+	}
+	return nil
+}
+
+// skip consumes the next value, token by token.
+func skip(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// Wrap returns the content to write before and after the users array so that the
+// array ends up at path inside template. A nil template is built from the path
+// alone, e.g. {"data":{"users":[...]}} for data.users.
+func Wrap(template []byte, path []string) ([]byte, []byte, error) {
+	if len(path) == 0 {
+		return nil, nil, nil
+	}
+
+	var doc interface{} = map[string]interface{}{}
+	if len(template) != 0 {
+		decoder := json.NewDecoder(bytes.NewReader(template))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, nil, fmt.Errorf("invalid template: %w", err)
+		}
+	}
+
+	doc, err := set(doc, path, placeholder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	quoted, err := json.Marshal(placeholder)
+	if err != nil {
+		return nil, nil, err
+	}
+	i := bytes.Index(b, quoted)
+
+	return b[:i], b[i+len(quoted):], nil
+}
+
+func set(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			child = map[string]interface{}{}
+		}
+		v, err := set(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = v
+		return n, nil
+	case []interface{}:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(n) {
+			return nil, fmt.Errorf("'%s' is not a valid index", path[0])
+		}
+		v, err := set(n[index], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[index] = v
+		return n, nil
+	default:
+		return nil, fmt.Errorf("'%s' is not an object or an array", path[0])
+	}
+}
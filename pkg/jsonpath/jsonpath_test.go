@@ -0,0 +1,81 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	assert := require.New(t)
+
+	segments, err := Parse("data.users")
+	assert.Nil(err)
+	assert.Equal([]string{"data", "users"}, segments)
+
+	segments, err = Parse("/data/a~1b/c~0d")
+	assert.Nil(err)
+	assert.Equal([]string{"data", "a/b", "c~d"}, segments)
+
+	segments, err = Parse("")
+	assert.Nil(err)
+	assert.Empty(segments)
+
+	_, err = Parse("data..users")
+	assert.NotNil(err)
+}
+
+func TestSeek(t *testing.T) {
+	assert := require.New(t)
+
+	decoder := json.NewDecoder(strings.NewReader(`{"skip":{"users":[1]},"pages":[{"users":[2]},{"users":[3,4]}]}`))
+	err := Seek(decoder, []string{"pages", "1", "users"})
+	assert.Nil(err)
+
+	var v int
+	assert.True(decoder.More())
+	assert.Nil(decoder.Decode(&v))
+	assert.Equal(3, v)
+}
+
+func TestSeekNotFound(t *testing.T) {
+	assert := require.New(t)
+
+	decoder := json.NewDecoder(strings.NewReader(`{"data":{"count":2}}`))
+	err := Seek(decoder, []string{"data", "users"})
+	assert.NotNil(err)
+	assert.Equal("'users' not found", err.Error())
+}
+
+func TestSeekNotAnArray(t *testing.T) {
+	assert := require.New(t)
+
+	decoder := json.NewDecoder(strings.NewReader(`{"data":{"users":{}}}`))
+	err := Seek(decoder, []string{"data", "users"})
+	assert.NotNil(err)
+	assert.Equal("'data.users' is not an array", err.Error())
+
+	decoder = json.NewDecoder(strings.NewReader(`{"users":[]}`))
+	err = Seek(decoder, nil)
+	assert.NotNil(err)
+	assert.Equal("the top-level value is not an array", err.Error())
+}
+
+func TestWrap(t *testing.T) {
+	assert := require.New(t)
+
+	prefix, suffix, err := Wrap(nil, []string{"data", "users"})
+	assert.Nil(err)
+	assert.Equal(`{"data":{"users":`, string(prefix))
+	assert.Equal(`}}`, string(suffix))
+
+	prefix, suffix, err = Wrap([]byte(`{"next":null,"data":{"users":[{"id":"1"}],"count":2}}`), []string{"data", "users"})
+	assert.Nil(err)
+	assert.Equal(`{"data":{"count":2,"users":`, string(prefix))
+	assert.Equal(`},"next":null}`, string(suffix))
+
+	_, _, err = Wrap([]byte(`{"data":"x"}`), []string{"data", "users"})
+	assert.NotNil(err)
+}
@@ -0,0 +1,247 @@
+package ldif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const maxLineLength = 76
+
+// Attribute is a named, multi-valued LDAP attribute.
+type Attribute struct {
+	Name   string
+	Values []string
+}
+
+// Entry is a single LDIF record.
+type Entry struct {
+	DN         string
+	Attributes []*Attribute
+}
+
+// Get returns the values of the attribute with the given name, ignoring case.
+func (e *Entry) Get(name string) []string {
+	for _, a := range e.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a.Values
+		}
+	}
+	return nil
+}
+
+// Add appends values to the attribute with the given name, creating it when missing.
+func (e *Entry) Add(name string, values ...string) {
+	for _, a := range e.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			a.Values = append(a.Values, values...)
+			return
+		}
+	}
+	e.Attributes = append(e.Attributes, &Attribute{Name: name, Values: values})
+}
+
+// Reader reads LDIF content records as described by RFC 2849.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+	pending string
+	hasNext bool
+	// failed is set once the input could not be read, the reader cannot go on
+	failed bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next entry, or io.EOF when the input is exhausted. An error
+// reading the input, rather than parsing it, is returned once and the input is
+// exhausted afterwards.
+func (r *Reader) Next() (*Entry, error) {
+	lines, err := r.record()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{}
+	for i, line := range lines {
+		name, value, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+
+		switch {
+		case i == 0 && strings.EqualFold(name, "version"):
+			continue
+		case entry.DN == "" && strings.EqualFold(name, "dn"):
+			entry.DN = value
+		case entry.DN == "":
+			return nil, fmt.Errorf("line %d: expected dn, found '%s'", r.line, name)
+		case strings.EqualFold(name, "changetype"):
+			if !strings.EqualFold(value, "add") {
+				return nil, fmt.Errorf("line %d: unsupported changetype '%s'", r.line, value)
+			}
+		default:
+			entry.Add(name, value)
+		}
+	}
+
+	if entry.DN == "" {
+		return r.Next()
+	}
+
+	return entry, nil
+}
+
+// record returns the unfolded lines of the next non empty record.
+func (r *Reader) record() ([]string, error) {
+	var lines []string
+
+	for {
+		if r.failed {
+			return nil, io.EOF
+		}
+		line, ok := r.nextLine()
+		if !ok {
+			if err := r.scanner.Err(); err != nil {
+				r.failed = true
+				return nil, err
+			}
+			if len(lines) == 0 {
+				return nil, io.EOF
+			}
+			return lines, nil
+		}
+
+		switch {
+		case line == "":
+			if len(lines) > 0 {
+				return lines, nil
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			lines = append(lines, line)
+		}
+	}
+}
+
+// nextLine returns the next logical line, joining continuation lines.
+func (r *Reader) nextLine() (string, bool) {
+	var line string
+	if r.hasNext {
+		line = r.pending
+		r.hasNext = false
+	} else {
+		if !r.scanner.Scan() {
+			return "", false
+		}
+		r.line++
+		line = strings.TrimRight(r.scanner.Text(), "\r")
+	}
+
+	if line == "" {
+		return line, true
+	}
+
+	for r.scanner.Scan() {
+		r.line++
+		next := strings.TrimRight(r.scanner.Text(), "\r")
+		if !strings.HasPrefix(next, " ") {
+			r.pending = next
+			r.hasNext = true
+			break
+		}
+		line += next[1:]
+	}
+
+	return line, true
+}
+
+func parseLine(line string) (string, string, error) {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid line '%s'", line)
+	}
+
+	name := line[:i]
+	// attribute options such as language tags are not mapped
+	if j := strings.Index(name, ";"); j > 0 {
+		name = name[:j]
+	}
+	rest := line[i+1:]
+
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value for '%s': %w", name, err)
+		}
+		return name, string(b), nil
+	case strings.HasPrefix(rest, "<"):
+		return "", "", fmt.Errorf("url values are not supported for '%s'", name)
+	default:
+		return name, strings.TrimLeft(rest, " "), nil
+	}
+}
+
+// Header is the version line starting an LDIF file.
+const Header = "version: 1\n"
+
+// Marshal returns the LDIF record of entry, without the separating empty line.
+func Marshal(entry *Entry) []byte {
+	var buf bytes.Buffer
+
+	writeValue(&buf, "dn", entry.DN)
+	for _, a := range entry.Attributes {
+		for _, v := range a.Values {
+			writeValue(&buf, a.Name, v)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func writeValue(buf *bytes.Buffer, name, value string) {
+	line := name + ": " + value
+	if !isSafe(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	width := maxLineLength
+	for len(line) > width {
+		buf.WriteString(line[:width])
+		buf.WriteString("\n ")
+		line = line[width:]
+		// continuation lines start with a space
+		width = maxLineLength - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\n")
+}
+
+// isSafe reports whether value can be written as a SAFE-STRING (RFC 2849).
+func isSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == 0 || c == '\n' || c == '\r' || c > 127 {
+			return false
+		}
+	}
+	return true
+}
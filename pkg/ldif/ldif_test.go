@@ -0,0 +1,155 @@
+package ldif
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const entries = `version: 1
+
+# comment
+dn: uid=euang,ou=people,dc=acmecorp,dc=com
+objectClass: inetOrgPerson
+uid: euang
+cn: Euan Garden
+mail: euang@acmecorp.com
+telephoneNumber: +1-804-555-3383
+manager: uid=chrisjohns,ou=people,dc=acmecorp,dc=com
+memberOf: cn=sales,ou=groups,
+ dc=acmecorp,dc=com
+description:: w6lsw6h2ZQ==
+
+dn: uid=chrisjohns,ou=people,dc=acmecorp,dc=com
+uid: chrisjohns
+`
+
+func TestReadEntries(t *testing.T) {
+	assert := require.New(t)
+
+	r := NewReader(strings.NewReader(entries))
+
+	entry, err := r.Next()
+	assert.Nil(err)
+	assert.Equal("uid=euang,ou=people,dc=acmecorp,dc=com", entry.DN)
+	assert.Equal([]string{"Euan Garden"}, entry.Get("CN"))
+	assert.Equal([]string{"cn=sales,ou=groups,dc=acmecorp,dc=com"}, entry.Get("memberOf"))
+	assert.Equal([]string{"élève"}, entry.Get("description"))
+
+	entry, err = r.Next()
+	assert.Nil(err)
+	assert.Equal("uid=chrisjohns,ou=people,dc=acmecorp,dc=com", entry.DN)
+
+	_, err = r.Next()
+	assert.Equal(io.EOF, err)
+}
+
+func TestReadUnsupportedChangeType(t *testing.T) {
+	assert := require.New(t)
+
+	r := NewReader(strings.NewReader("dn: uid=a,dc=com\nchangetype: delete\n"))
+
+	_, err := r.Next()
+	assert.NotNil(err)
+	assert.Equal("line 2: unsupported changetype 'delete'", err.Error())
+}
+
+func TestReadTooLongLine(t *testing.T) {
+	assert := require.New(t)
+
+	long := "dn: uid=a,dc=com\ndescription: " + strings.Repeat("x", 17*1024*1024) + "\n"
+	r := NewReader(strings.NewReader(long))
+
+	_, err := r.Next()
+	assert.Equal(bufio.ErrTooLong, err)
+
+	// the reader cannot go on past the error
+	_, err = r.Next()
+	assert.Equal(io.EOF, err)
+}
+
+func TestToUser(t *testing.T) {
+	assert := require.New(t)
+
+	r := NewReader(strings.NewReader(entries))
+	entry, err := r.Next()
+	assert.Nil(err)
+
+	user := DefaultAttributeMap().ToUser(entry)
+	assert.Equal("euang", user.Id)
+	assert.Equal("Euan Garden", user.DisplayName)
+	assert.Equal("euang@acmecorp.com", user.Email)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_DN, user.Identities["uid=euang,ou=people,dc=acmecorp,dc=com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_USERNAME, user.Identities["euang"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["+1-804-555-3383"].Kind)
+	assert.Equal("chrisjohns", user.Attributes.Properties.Fields["manager"].GetStringValue())
+	assert.Equal([]string{"sales"}, user.Attributes.Roles)
+}
+
+func TestParseAttributeMap(t *testing.T) {
+	assert := require.New(t)
+
+	m, err := ParseAttributeMap("employeeNumber=id,uid=username,description=notes")
+	assert.Nil(err)
+
+	entry := &Entry{DN: "cn=a,dc=com"}
+	entry.Add("employeeNumber", "42")
+	entry.Add("uid", "euang")
+	entry.Add("description", "on leave")
+
+	user := m.ToUser(entry)
+	assert.Equal("42", user.Id)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_USERNAME, user.Identities["euang"].Kind)
+	assert.Equal("on leave", user.Attributes.Properties.Fields["notes"].GetStringValue())
+
+	_, err = ParseAttributeMap("uid")
+	assert.NotNil(err)
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	r := NewReader(strings.NewReader(entries))
+	entry, err := r.Next()
+	assert.Nil(err)
+
+	m := DefaultAttributeMap()
+	user := m.ToUser(entry)
+
+	var buf bytes.Buffer
+	buf.WriteString(Header + "\n")
+	buf.Write(Marshal(m.ToEntry(user, "ou=people,dc=acmecorp,dc=com")))
+
+	out := buf.String()
+	assert.True(strings.HasPrefix(out, "version: 1\n\ndn: uid=euang,ou=people,dc=acmecorp,dc=com\n"))
+	assert.Contains(out, "sn: Garden\n")
+	assert.Contains(out, "manager: uid=chrisjohns,ou=people,dc=acmecorp,dc=com\n")
+
+	roundTrip, err := NewReader(&buf).Next()
+	assert.Nil(err)
+	assert.Equal(user.Id, m.ToUser(roundTrip).Id)
+	assert.Equal(user.Email, m.ToUser(roundTrip).Email)
+}
+
+func TestWriteUnsafeValue(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	entry := &Entry{DN: "uid=a,dc=com"}
+	entry.Add("cn", "élève")
+	entry.Add("description", strings.Repeat("x", 100))
+
+	buf.WriteString(Header + "\n")
+	buf.Write(Marshal(entry))
+	assert.Contains(buf.String(), "cn:: w6lsw6h2ZQ==\n")
+
+	read, err := NewReader(&buf).Next()
+	assert.Nil(err)
+	assert.Equal([]string{"élève"}, read.Get("cn"))
+	assert.Equal([]string{strings.Repeat("x", 100)}, read.Get("description"))
+}
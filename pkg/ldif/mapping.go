@@ -0,0 +1,276 @@
+package ldif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Targets of the attribute map, any other target names a key of attributes.properties.
+const (
+	TargetID          = "id"
+	TargetDisplayName = "display_name"
+	TargetEmail       = "email"
+	TargetPicture     = "picture"
+	TargetUsername    = "username"
+	TargetPhone       = "phone"
+	TargetManager     = "manager"
+	TargetRoles       = "roles"
+	TargetPermissions = "permissions"
+)
+
+const (
+	provider       = "ldap"
+	defaultRDNAttr = "uid"
+)
+
+// AttributeMap maps LDAP attribute names to api.User fields.
+type AttributeMap struct {
+	entries []mapEntry
+}
+
+type mapEntry struct {
+	attribute string
+	target    string
+}
+
+// DefaultAttributeMap returns the mapping of the inetOrgPerson attributes.
+func DefaultAttributeMap() *AttributeMap {
+	return &AttributeMap{entries: []mapEntry{
+		{"uid", TargetID},
+		{"uid", TargetUsername},
+		{"cn", TargetDisplayName},
+		{"mail", TargetEmail},
+		{"telephoneNumber", TargetPhone},
+		{"manager", TargetManager},
+		{"memberOf", TargetRoles},
+		{"title", "title"},
+		{"departmentNumber", "department"},
+	}}
+}
+
+// ParseAttributeMap returns the default attribute map overridden by spec, a comma
+// separated list of attribute=target pairs. An attribute given in spec replaces all
+// of its default targets, an attribute mapped to an empty target is dropped.
+func ParseAttributeMap(spec string) (*AttributeMap, error) {
+	m := DefaultAttributeMap()
+	if strings.TrimSpace(spec) == "" {
+		return m, nil
+	}
+
+	overrides := []mapEntry{}
+	replaced := map[string]bool{}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid attribute mapping '%s'", pair)
+		}
+		attr := strings.TrimSpace(parts[0])
+		replaced[strings.ToLower(attr)] = true
+		if target := strings.TrimSpace(parts[1]); target != "" {
+			overrides = append(overrides, mapEntry{attr, target})
+		}
+	}
+
+	entries := []mapEntry{}
+	for _, e := range m.entries {
+		if !replaced[strings.ToLower(e.attribute)] {
+			entries = append(entries, e)
+		}
+	}
+	m.entries = append(entries, overrides...)
+
+	return m, nil
+}
+
+// ToUser converts an LDIF entry to an api.User.
+func (m *AttributeMap) ToUser(entry *Entry) *api.User {
+	user := &api.User{
+		Identities: make(map[string]*api.IdentitySource),
+		Attributes: &api.AttrSet{
+			Properties:  &structpb.Struct{Fields: make(map[string]*structpb.Value)},
+			Roles:       []string{},
+			Permissions: []string{},
+		},
+		Applications: make(map[string]*api.AttrSet),
+		Metadata:     &api.Metadata{},
+	}
+	user.Identities[entry.DN] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_DN, Provider: provider}
+
+	for _, e := range m.entries {
+		for _, value := range entry.Get(e.attribute) {
+			m.set(user, e.target, value)
+		}
+	}
+
+	return user
+}
+
+func (m *AttributeMap) set(user *api.User, target, value string) {
+	switch target {
+	case TargetID:
+		if user.Id == "" {
+			user.Id = value
+		}
+	case TargetDisplayName:
+		if user.DisplayName == "" {
+			user.DisplayName = value
+		}
+	case TargetEmail:
+		if user.Email == "" {
+			user.Email = value
+		}
+		addIdentity(user, value, api.IdentityKind_IDENTITY_KIND_EMAIL)
+	case TargetPicture:
+		if user.Picture == "" {
+			user.Picture = value
+		}
+	case TargetUsername:
+		addIdentity(user, value, api.IdentityKind_IDENTITY_KIND_USERNAME)
+	case TargetPhone:
+		addIdentity(user, value, api.IdentityKind_IDENTITY_KIND_PHONE)
+		setProperty(user, TargetPhone, value)
+	case TargetManager:
+		setProperty(user, TargetManager, rdnValue(value))
+	case TargetRoles:
+		user.Attributes.Roles = append(user.Attributes.Roles, rdnValue(value))
+	case TargetPermissions:
+		user.Attributes.Permissions = append(user.Attributes.Permissions, value)
+	default:
+		setProperty(user, target, value)
+	}
+}
+
+// ToEntry converts an api.User to an LDIF entry. The DN identity of the user is
+// used when present, otherwise the DN is built from the user id and baseDN.
+func (m *AttributeMap) ToEntry(user *api.User, baseDN string) *Entry {
+	entry := &Entry{DN: userDN(user, baseDN)}
+	entry.Add("objectClass", "top", "person", "organizationalPerson", "inetOrgPerson")
+
+	seen := map[string]bool{}
+	for _, e := range m.entries {
+		values := m.get(user, e.target, baseDN)
+		for _, v := range values {
+			key := strings.ToLower(e.attribute) + "\x00" + v
+			if v == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			entry.Add(e.attribute, v)
+		}
+	}
+
+	// sn is mandatory for the person object class
+	if entry.Get("sn") == nil {
+		entry.Add("sn", surname(user))
+	}
+	if entry.Get("cn") == nil {
+		entry.Add("cn", user.DisplayName)
+	}
+
+	return entry
+}
+
+func (m *AttributeMap) get(user *api.User, target, baseDN string) []string {
+	switch target {
+	case TargetID:
+		return []string{user.Id}
+	case TargetDisplayName:
+		return []string{user.DisplayName}
+	case TargetEmail:
+		return []string{user.Email}
+	case TargetPicture:
+		return []string{user.Picture}
+	case TargetUsername:
+		return identities(user, api.IdentityKind_IDENTITY_KIND_USERNAME)
+	case TargetPhone:
+		return identities(user, api.IdentityKind_IDENTITY_KIND_PHONE)
+	case TargetManager:
+		manager := property(user, TargetManager)
+		if manager == "" || strings.Contains(manager, "=") {
+			return []string{manager}
+		}
+		return []string{joinDN(defaultRDNAttr+"="+manager, baseDN)}
+	case TargetRoles:
+		roles := []string{}
+		for _, r := range user.GetAttributes().GetRoles() {
+			roles = append(roles, joinDN("cn="+r, baseDN))
+		}
+		return roles
+	case TargetPermissions:
+		return user.GetAttributes().GetPermissions()
+	default:
+		return []string{property(user, target)}
+	}
+}
+
+func userDN(user *api.User, baseDN string) string {
+	keys := []string{}
+	for key, identity := range user.Identities {
+		if identity.GetKind() == api.IdentityKind_IDENTITY_KIND_DN {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		return keys[0]
+	}
+
+	return joinDN(defaultRDNAttr+"="+user.Id, baseDN)
+}
+
+func joinDN(rdn, baseDN string) string {
+	if baseDN == "" {
+		return rdn
+	}
+	return rdn + "," + baseDN
+}
+
+// rdnValue returns the value of the first RDN when value is a DN, or value itself.
+func rdnValue(value string) string {
+	rdn := strings.SplitN(value, ",", 2)[0]
+	if i := strings.Index(rdn, "="); i > 0 {
+		return strings.TrimSpace(rdn[i+1:])
+	}
+	return value
+}
+
+func surname(user *api.User) string {
+	parts := strings.Fields(user.DisplayName)
+	if len(parts) == 0 {
+		return user.Id
+	}
+	return parts[len(parts)-1]
+}
+
+func identities(user *api.User, kind api.IdentityKind) []string {
+	keys := []string{}
+	for key, identity := range user.Identities {
+		if identity.GetKind() == kind {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func addIdentity(user *api.User, key string, kind api.IdentityKind) {
+	if _, ok := user.Identities[key]; ok {
+		return
+	}
+	user.Identities[key] = &api.IdentitySource{Kind: kind, Provider: provider}
+}
+
+func setProperty(user *api.User, key, value string) {
+	if _, ok := user.Attributes.Properties.Fields[key]; ok {
+		return
+	}
+	user.Attributes.Properties.Fields[key] = structpb.NewStringValue(value)
+}
+
+func property(user *api.User, key string) string {
+	return user.GetAttributes().GetProperties().GetFields()[key].GetStringValue()
+}
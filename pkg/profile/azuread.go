@@ -0,0 +1,90 @@
+package profile
+
+import (
+	"encoding/json"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+)
+
+const azureADProvider = "azuread"
+
+// azureADUser is a user resource as returned by the Microsoft Graph /users endpoint.
+type azureADUser struct {
+	ID                string          `json:"id"`
+	AccountEnabled    *bool           `json:"accountEnabled"`
+	DisplayName       string          `json:"displayName"`
+	UserPrincipalName string          `json:"userPrincipalName"`
+	Mail              string          `json:"mail"`
+	JobTitle          string          `json:"jobTitle"`
+	Department        string          `json:"department"`
+	MobilePhone       string          `json:"mobilePhone"`
+	BusinessPhones    []string        `json:"businessPhones"`
+	CreatedDateTime   string          `json:"createdDateTime"`
+	DeletedDateTime   string          `json:"deletedDateTime"`
+	Manager           json.RawMessage `json:"manager"`
+}
+
+func unmarshalAzureAD(b []byte) (*api.User, error) {
+	var src azureADUser
+	if err := json.Unmarshal(b, &src); err != nil {
+		return nil, err
+	}
+
+	user := newUser(src.ID)
+	user.Enabled = src.AccountEnabled
+	user.DisplayName = src.DisplayName
+	user.Email = src.Mail
+	if user.Email == "" {
+		user.Email = src.UserPrincipalName
+	}
+
+	phone := src.MobilePhone
+	if phone == "" && len(src.BusinessPhones) > 0 {
+		phone = src.BusinessPhones[0]
+	}
+
+	if src.ID != "" {
+		addIdentity(user, src.ID, api.IdentityKind_IDENTITY_KIND_PID, azureADProvider, true)
+	}
+	addIdentity(user, src.UserPrincipalName, api.IdentityKind_IDENTITY_KIND_USERNAME, azureADProvider, true)
+	addIdentity(user, src.Mail, api.IdentityKind_IDENTITY_KIND_EMAIL, azureADProvider, true)
+	addIdentity(user, phone, api.IdentityKind_IDENTITY_KIND_PHONE, "", false)
+
+	manager, err := azureADManager(src.Manager)
+	if err != nil {
+		return nil, err
+	}
+	setProperty(user, "department", src.Department)
+	setProperty(user, "title", src.JobTitle)
+	setProperty(user, "manager", manager)
+	setProperty(user, "phone", phone)
+
+	user.Metadata.CreatedAt = parseTime(src.CreatedDateTime)
+	if src.DeletedDateTime != "" {
+		user.Deleted = true
+		user.Metadata.DeletedAt = parseTime(src.DeletedDateTime)
+	}
+
+	return user, nil
+}
+
+// azureADManager returns the id of the manager reference, which is either the
+// expanded directory object ($expand=manager) or a plain id string.
+func azureADManager(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id, nil
+	}
+
+	var obj struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return "", err
+	}
+	return obj.ID, nil
+}
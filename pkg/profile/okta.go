@@ -0,0 +1,79 @@
+package profile
+
+import (
+	"encoding/json"
+	"strings"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+)
+
+const oktaProvider = "okta"
+
+// oktaUser is a user object as returned by the Okta /api/v1/users endpoint.
+type oktaUser struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Created     string `json:"created"`
+	LastUpdated string `json:"lastUpdated"`
+	Profile     struct {
+		Login        string `json:"login"`
+		Email        string `json:"email"`
+		FirstName    string `json:"firstName"`
+		LastName     string `json:"lastName"`
+		DisplayName  string `json:"displayName"`
+		Title        string `json:"title"`
+		Department   string `json:"department"`
+		Manager      string `json:"manager"`
+		ManagerID    string `json:"managerId"`
+		MobilePhone  string `json:"mobilePhone"`
+		PrimaryPhone string `json:"primaryPhone"`
+	} `json:"profile"`
+}
+
+func unmarshalOkta(b []byte) (*api.User, error) {
+	var src oktaUser
+	if err := json.Unmarshal(b, &src); err != nil {
+		return nil, err
+	}
+
+	user := newUser(src.ID)
+	p := &src.Profile
+
+	enabled := src.Status != "SUSPENDED" && src.Status != "DEPROVISIONED"
+	user.Enabled = &enabled
+	user.DisplayName = p.DisplayName
+	if user.DisplayName == "" {
+		user.DisplayName = strings.TrimSpace(p.FirstName + " " + p.LastName)
+	}
+	user.Email = p.Email
+
+	phone := p.MobilePhone
+	if phone == "" {
+		phone = p.PrimaryPhone
+	}
+
+	if src.ID != "" {
+		addIdentity(user, oktaProvider+"|"+src.ID, api.IdentityKind_IDENTITY_KIND_PID, oktaProvider, true)
+	}
+	addIdentity(user, p.Email, api.IdentityKind_IDENTITY_KIND_EMAIL, oktaProvider, true)
+	if strings.Contains(p.Login, "@") {
+		addIdentity(user, p.Login, api.IdentityKind_IDENTITY_KIND_EMAIL, oktaProvider, true)
+	} else {
+		addIdentity(user, p.Login, api.IdentityKind_IDENTITY_KIND_USERNAME, oktaProvider, true)
+	}
+	addIdentity(user, phone, api.IdentityKind_IDENTITY_KIND_PHONE, "", false)
+
+	manager := p.ManagerID
+	if manager == "" {
+		manager = p.Manager
+	}
+	setProperty(user, "department", p.Department)
+	setProperty(user, "title", p.Title)
+	setProperty(user, "manager", manager)
+	setProperty(user, "phone", phone)
+
+	user.Metadata.CreatedAt = parseTime(src.Created)
+	user.Metadata.UpdatedAt = parseTime(src.LastUpdated)
+
+	return user, nil
+}
@@ -0,0 +1,97 @@
+package profile
+
+import (
+	"strings"
+	"time"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	Aserto  = "aserto"
+	Okta    = "okta"
+	AzureAD = "azuread"
+)
+
+// Unmarshaler converts a single JSON record of a source export into an api.User.
+type Unmarshaler func([]byte) (*api.User, error)
+
+type Profile struct {
+	Name string
+	// UsersPath is the key of the array holding the users when the export
+	// wraps them in an object, empty when the document is the array itself.
+	UsersPath string
+	Unmarshal Unmarshaler
+}
+
+var profiles = map[string]*Profile{ // nolint:gochecknoglobals // registry
+	Aserto:  {Name: Aserto, Unmarshal: unmarshalAserto},
+	Okta:    {Name: Okta, Unmarshal: unmarshalOkta},
+	AzureAD: {Name: AzureAD, UsersPath: "value", Unmarshal: unmarshalAzureAD},
+}
+
+// Get returns the profile registered under name, an empty name selects the aserto profile.
+func Get(name string) (*Profile, bool) {
+	if name == "" {
+		name = Aserto
+	}
+	p, ok := profiles[strings.ToLower(name)]
+	return p, ok
+}
+
+func unmarshalAserto(b []byte) (*api.User, error) {
+	u := api.User{}
+	if err := protojson.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func newUser(id string) *api.User {
+	return &api.User{
+		Id:         id,
+		Identities: make(map[string]*api.IdentitySource),
+		Attributes: &api.AttrSet{
+			Properties:  &structpb.Struct{Fields: make(map[string]*structpb.Value)},
+			Roles:       []string{},
+			Permissions: []string{},
+		},
+		Applications: make(map[string]*api.AttrSet),
+		Metadata:     &api.Metadata{},
+	}
+}
+
+func addIdentity(user *api.User, key string, kind api.IdentityKind, provider string, verified bool) {
+	if key == "" {
+		return
+	}
+	if _, ok := user.Identities[key]; ok {
+		return
+	}
+	user.Identities[key] = &api.IdentitySource{
+		Kind:     kind,
+		Provider: provider,
+		Verified: verified,
+	}
+}
+
+func setProperty(user *api.User, key, value string) {
+	if value == "" {
+		return
+	}
+	user.Attributes.Properties.Fields[key] = structpb.NewStringValue(value)
+}
+
+func parseTime(value string) *timestamppb.Timestamp {
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil
+	}
+	return timestamppb.New(t)
+}
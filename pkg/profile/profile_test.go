@@ -0,0 +1,105 @@
+package profile
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDefaultProfile(t *testing.T) {
+	assert := require.New(t)
+
+	p, ok := Get("")
+	assert.True(ok)
+	assert.Equal(Aserto, p.Name)
+
+	_, ok = Get("ldap")
+	assert.False(ok)
+}
+
+func TestUnmarshalOkta(t *testing.T) {
+	assert := require.New(t)
+
+	user, err := unmarshalOkta([]byte(`{
+		"id": "00ub0oNGTSWTBKOLGLNR",
+		"status": "ACTIVE",
+		"created": "2013-06-24T16:39:18.000Z",
+		"lastUpdated": "2013-07-02T21:36:25.344Z",
+		"profile": {
+			"firstName": "Isaac",
+			"lastName": "Brock",
+			"email": "isaac.brock@example.com",
+			"login": "isaac.brock",
+			"mobilePhone": "+1-555-415-1337",
+			"title": "Engineer",
+			"department": "Engineering",
+			"managerId": "00ub0oNGTSWTBKOLGLNQ"
+		}
+	}`))
+	assert.Nil(err)
+
+	assert.Equal("00ub0oNGTSWTBKOLGLNR", user.Id)
+	assert.True(user.GetEnabled())
+	assert.Equal("Isaac Brock", user.DisplayName)
+	assert.Equal("isaac.brock@example.com", user.Email)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PID, user.Identities["okta|00ub0oNGTSWTBKOLGLNR"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_EMAIL, user.Identities["isaac.brock@example.com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_USERNAME, user.Identities["isaac.brock"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["+1-555-415-1337"].Kind)
+	assert.Equal("Engineering", user.Attributes.Properties.Fields["department"].GetStringValue())
+	assert.Equal("Engineer", user.Attributes.Properties.Fields["title"].GetStringValue())
+	assert.Equal("00ub0oNGTSWTBKOLGLNQ", user.Attributes.Properties.Fields["manager"].GetStringValue())
+	assert.Equal("2013-06-24T16:39:18Z", user.Metadata.CreatedAt.AsTime().Format(time.RFC3339))
+}
+
+func TestUnmarshalOktaSuspended(t *testing.T) {
+	assert := require.New(t)
+
+	user, err := unmarshalOkta([]byte(`{"id": "1", "status": "SUSPENDED", "profile": {"displayName": "Ann Lee", "login": "ann.lee@example.com"}}`))
+	assert.Nil(err)
+
+	assert.False(user.GetEnabled())
+	assert.Equal("Ann Lee", user.DisplayName)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_EMAIL, user.Identities["ann.lee@example.com"].Kind)
+}
+
+func TestUnmarshalAzureAD(t *testing.T) {
+	assert := require.New(t)
+
+	user, err := unmarshalAzureAD([]byte(`{
+		"id": "87d349ed-44d7-43e1-9a83-5f2406dee5bd",
+		"accountEnabled": true,
+		"displayName": "Adele Vance",
+		"userPrincipalName": "AdeleV@contoso.onmicrosoft.com",
+		"mail": "AdeleV@contoso.com",
+		"jobTitle": "Retail Manager",
+		"department": "Retail",
+		"businessPhones": ["+1 425 555 0109"],
+		"manager": {"id": "5bde3e51-d13b-4db1-9948-fe4b109d11a7"}
+	}`))
+	assert.Nil(err)
+
+	assert.Equal("87d349ed-44d7-43e1-9a83-5f2406dee5bd", user.Id)
+	assert.True(user.GetEnabled())
+	assert.Equal("AdeleV@contoso.com", user.Email)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PID, user.Identities["87d349ed-44d7-43e1-9a83-5f2406dee5bd"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_USERNAME, user.Identities["AdeleV@contoso.onmicrosoft.com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_EMAIL, user.Identities["AdeleV@contoso.com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["+1 425 555 0109"].Kind)
+	assert.Equal("Retail Manager", user.Attributes.Properties.Fields["title"].GetStringValue())
+	assert.Equal("5bde3e51-d13b-4db1-9948-fe4b109d11a7", user.Attributes.Properties.Fields["manager"].GetStringValue())
+}
+
+func TestUnmarshalAzureADManagerID(t *testing.T) {
+	assert := require.New(t)
+
+	user, err := unmarshalAzureAD([]byte(`{"id": "1", "userPrincipalName": "a@contoso.com", "manager": "2", "deletedDateTime": "2021-10-04T11:41:12Z"}`))
+	assert.Nil(err)
+
+	assert.Equal("a@contoso.com", user.Email)
+	assert.Equal("2", user.Attributes.Properties.Fields["manager"].GetStringValue())
+	assert.True(user.Deleted)
+	assert.NotNil(user.Metadata.DeletedAt)
+}
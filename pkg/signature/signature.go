@@ -0,0 +1,159 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/atomicfile"
+)
+
+const (
+	ChecksumExt  = ".sha256"
+	SignatureExt = ".sig"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 ed25519 private key, as generated by
+// openssl genpkey -algorithm ed25519.
+func LoadPrivateKey(file string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key '%s': %w", file, err)
+	}
+
+	pk, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an ed25519 private key", file)
+	}
+	return pk, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX ed25519 public key.
+func LoadPublicKey(file string) (ed25519.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key '%s': %w", file, err)
+	}
+
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an ed25519 public key", file)
+	}
+	return pk, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("'%s' is not PEM encoded", file)
+	}
+	return block, nil
+}
+
+// Sign writes the SHA-256 checksum manifest of file next to it, in the format of
+// sha256sum, and the ed25519 signature of that manifest.
+func Sign(file string, key ed25519.PrivateKey) error {
+	manifest, err := checksum(file)
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteFile(file+ChecksumExt, manifest, 0600); err != nil {
+		return err
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest))
+
+	return atomicfile.WriteFile(file+SignatureExt, []byte(sig+"\n"), 0600)
+}
+
+// Verify checks the signature of the checksum manifest of file and that the
+// checksum matches the content of file.
+func Verify(file string, key ed25519.PublicKey) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return VerifyReader(file, f, key)
+}
+
+// VerifyReader checks the signature of the checksum manifest of file and that
+// the checksum matches the content read from r, such as an open handle of file
+// which is then known to hold the signed content.
+func VerifyReader(file string, r io.Reader, key ed25519.PublicKey) error {
+	manifest, err := os.ReadFile(file + ChecksumExt)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(file + SignatureExt)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || !ed25519.Verify(key, manifest, sig) {
+		return ErrInvalidSignature
+	}
+
+	actual, err := checksumOf(file, r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(manifest, actual) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+func checksum(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return checksumOf(file, f)
+}
+
+// checksumOf returns the manifest line of file for the content read from r.
+func checksumOf(file string, r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+
+	return []byte(hex.EncodeToString(h.Sum(nil)) + "  " + filepath.Base(file) + "\n"), nil
+}
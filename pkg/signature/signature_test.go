@@ -0,0 +1,150 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeys(dir string) (string, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+
+	privFile := filepath.Join(dir, "signing.pem")
+	err = os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	pubFile := filepath.Join(dir, "verify.pem")
+	err = os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	return privFile, pubFile, nil
+}
+
+func TestSignAndVerify(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	privFile, pubFile, err := writeKeys(dir)
+	assert.Nil(err)
+
+	priv, err := LoadPrivateKey(privFile)
+	assert.Nil(err)
+	pub, err := LoadPublicKey(pubFile)
+	assert.Nil(err)
+
+	file := filepath.Join(dir, "users.json")
+	err = os.WriteFile(file, []byte("[]\n"), 0600)
+	assert.Nil(err)
+
+	err = Sign(file, priv)
+	assert.Nil(err)
+
+	manifest, err := os.ReadFile(file + ChecksumExt)
+	assert.Nil(err)
+	assert.True(strings.HasSuffix(string(manifest), "  users.json\n"))
+
+	err = Verify(file, pub)
+	assert.Nil(err)
+
+	// the manifest and signature written aside are renamed in place
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.Nil(err)
+	assert.Empty(tmps)
+}
+
+func TestVerifyTamperedFile(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	privFile, pubFile, err := writeKeys(dir)
+	assert.Nil(err)
+
+	priv, err := LoadPrivateKey(privFile)
+	assert.Nil(err)
+	pub, err := LoadPublicKey(pubFile)
+	assert.Nil(err)
+
+	file := filepath.Join(dir, "users.json")
+	err = os.WriteFile(file, []byte("[]\n"), 0600)
+	assert.Nil(err)
+	err = Sign(file, priv)
+	assert.Nil(err)
+
+	err = os.WriteFile(file, []byte("[{}]\n"), 0600)
+	assert.Nil(err)
+	assert.Equal(ErrChecksumMismatch, Verify(file, pub))
+
+	// an edited checksum manifest is not covered by the signature
+	err = os.WriteFile(file+ChecksumExt, []byte("0000  users.json\n"), 0600)
+	assert.Nil(err)
+	assert.Equal(ErrInvalidSignature, Verify(file, pub))
+}
+
+func TestLoadWrongKeyType(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	_, pubFile, err := writeKeys(dir)
+	assert.Nil(err)
+
+	_, err = LoadPrivateKey(pubFile)
+	assert.NotNil(err)
+
+	_, err = LoadPublicKey(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(err)
+}
+
+func TestVerifyReaderChecksOpenHandle(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	privFile, pubFile, err := writeKeys(dir)
+	assert.Nil(err)
+
+	priv, err := LoadPrivateKey(privFile)
+	assert.Nil(err)
+	pub, err := LoadPublicKey(pubFile)
+	assert.Nil(err)
+
+	file := filepath.Join(dir, "users.json")
+	err = os.WriteFile(file, []byte("[]\n"), 0600)
+	assert.Nil(err)
+	err = Sign(file, priv)
+	assert.Nil(err)
+
+	f, err := os.Open(file)
+	assert.Nil(err)
+	defer f.Close()
+
+	// a file swapped in after the handle was opened is not the one verified
+	swapped := filepath.Join(dir, "swapped.json")
+	err = os.WriteFile(swapped, []byte("[{}]\n"), 0600)
+	assert.Nil(err)
+	err = os.Rename(swapped, file)
+	assert.Nil(err)
+
+	assert.Nil(VerifyReader(file, f, pub))
+	assert.Equal(ErrChecksumMismatch, Verify(file, pub))
+}
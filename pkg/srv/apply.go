@@ -0,0 +1,175 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/diff"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/transform"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Outcomes of a change applied to a user file.
+const (
+	ChangeApplied  = "applied"
+	ChangeNotFound = "not_found"
+	ChangeExists   = "exists"
+	ChangeFailed   = "failed"
+)
+
+// ChangeResult is the outcome of a single change of a change-set.
+type ChangeResult struct {
+	ID     string `json:"id"`
+	Change string `json:"change"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Apply streams the users of the from-file of conf to its to-file, applying
+// changes on the way, and returns the outcome of every change in change-set
+// order. Added users are written after the users of from-file. Changes that
+// fail leave their user unchanged.
+func Apply(conf *config.JSONPluginConfig, changes []*diff.Change) ([]*ChangeResult, error) {
+	return NewJSONPlugin().Apply(conf, changes)
+}
+
+// Apply applies changes like the package function, stamping the users it
+// deletes with the clock of s.
+func (s *JSONPlugin) Apply(conf *config.JSONPluginConfig, changes []*diff.Change) (_ []*ChangeResult, err error) {
+	results := make([]*ChangeResult, len(changes))
+	byID := make(map[string]int, len(changes))
+	for i, change := range changes {
+		if _, ok := byID[change.ID]; ok {
+			return nil, fmt.Errorf("user '%s' is changed more than once", change.ID)
+		}
+		byID[change.ID] = i
+		results[i] = &ChangeResult{ID: change.ID, Change: change.Change, Status: ChangeNotFound}
+	}
+
+	// every user is rewritten, not the ones changed since the last read, and
+	// the read leaves the watermark and checkpoint of conf alone
+	c := *conf
+	c.Since, c.WatermarkFile, c.CheckpointFile = "", "", ""
+
+	// the lock is taken before from-file is read, so that a concurrent change
+	// of to-file is not overwritten with users read before it
+	if err := s.Open(conf, plugin.OperationTypeWrite); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.abort()
+		}
+	}()
+	// the reader normalizes, assigns ids and maps roles, which are not
+	// idempotent, so the users are only stamped and redacted on write
+	s.writeTransforms = transform.Chain{s.timestamps, s.redactor}
+
+	reader := NewJSONPlugin()
+	reader.Now = s.Now
+	if err := reader.Open(&c, plugin.OperationTypeRead); err != nil {
+		return nil, err
+	}
+	defer reader.Close() // nolint:errcheck // read stats are not used
+
+	for {
+		users, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// dropping the record would lose data
+			return nil, err
+		}
+
+		for _, user := range users {
+			if i, ok := byID[user.Id]; ok {
+				if user, err = s.applyChange(user, changes[i], results[i]); err != nil {
+					return nil, err
+				}
+			}
+			if user == nil {
+				continue
+			}
+			if err := s.Write(user); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i, change := range changes {
+		if change.Change != diff.Added || results[i].Status != ChangeNotFound {
+			continue
+		}
+		user, err := change.NewUser()
+		if err == nil {
+			// added users are not read, they are transformed like the read ones
+			err = reader.readTransforms.Apply(user)
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = ChangeFailed, err.Error()
+			continue
+		}
+		if err := s.Write(user); err != nil {
+			return nil, err
+		}
+		results[i].Status = ChangeApplied
+	}
+
+	if _, err := s.Close(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// applyChange returns user with change applied, nil when the change removes it.
+func (s *JSONPlugin) applyChange(user *api.User, change *diff.Change, result *ChangeResult) (*api.User, error) {
+	result.Status = ChangeApplied
+
+	switch change.Change {
+	case diff.Added:
+		result.Status = ChangeExists
+		return user, nil
+	case diff.Removed:
+		return nil, nil
+	}
+
+	changed := user
+	if len(change.Patch) > 0 {
+		patched, err := diff.Patch(user, change.Patch)
+		if err != nil {
+			result.Status, result.Error = ChangeFailed, err.Error()
+			return user, nil
+		}
+		changed = patched
+	}
+
+	switch {
+	case change.Change == diff.Deleted && len(change.Patch) == 0:
+		if changed.Metadata == nil {
+			changed.Metadata = &api.Metadata{}
+		}
+		changed.Deleted = true
+		changed.Metadata.DeletedAt = timestamppb.New(s.now().UTC())
+	case change.Change == diff.Restored && len(change.Patch) == 0:
+		changed.Deleted = false
+		if changed.Metadata != nil {
+			changed.Metadata.DeletedAt = nil
+		}
+	}
+	s.timestamps.Touch(changed)
+
+	return changed, nil
+}
+
+// String returns a one line account of the result.
+func (r *ChangeResult) String() string {
+	if r.Error != "" {
+		return fmt.Sprintf("%-8s %s %s: %s", r.Change, r.ID, r.Status, r.Error)
+	}
+	return fmt.Sprintf("%-8s %s %s", r.Change, r.ID, r.Status)
+}
@@ -0,0 +1,157 @@
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/atomicfile"
+)
+
+// defaultCheckpointEvery is the number of records read between checkpoints.
+const defaultCheckpointEvery = 1000
+
+// checkpoint is the position reached by a read. Offset is the position in the
+// plaintext of File after the last record returned, Record the number of records
+// of File read up to it.
+type checkpoint struct {
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Offset  int64     `json:"offset"`
+	Record  int64     `json:"record"`
+}
+
+// loadCheckpoint returns the checkpoint of the last interrupted read of the
+// source files, nil when there is none.
+func (s *JSONPlugin) loadCheckpoint() (*checkpoint, error) {
+	content, err := os.ReadFile(s.Config.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{}
+	if err := json.Unmarshal(content, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint '%s': %w", s.Config.CheckpointFile, err)
+	}
+
+	index := -1
+	for i, file := range s.files {
+		if file == cp.File {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("checkpoint '%s' is of '%s', which is not read", s.Config.CheckpointFile, cp.File)
+	}
+
+	info, err := os.Stat(cp.File)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != cp.Size || !info.ModTime().Equal(cp.ModTime) {
+		return nil, fmt.Errorf("'%s' changed after checkpoint '%s' was written", cp.File, s.Config.CheckpointFile)
+	}
+
+	// the files before the checkpoint were read by the interrupted read
+	for _, file := range s.files[:index] {
+		s.fileStats = append(s.fileStats, &FileStats{File: file})
+	}
+
+	return cp, nil
+}
+
+// saveCheckpoint writes the position after the last user handled when the
+// checkpoint interval elapsed or force is set.
+func (s *JSONPlugin) saveCheckpoint(force bool) error {
+	if s.Config.CheckpointFile == "" || s.Config.DryRun || s.handled.Record == 0 || s.handled == s.saved {
+		return nil
+	}
+	interval := int64(s.Config.CheckpointEvery)
+	if interval <= 0 {
+		interval = defaultCheckpointEvery
+	}
+	last := int64(0)
+	if s.saved.File == s.handled.File {
+		last = s.saved.Record
+	}
+	if !force && s.handled.Record-last < interval {
+		return nil
+	}
+
+	info, err := os.Stat(s.handled.File)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&checkpoint{
+		File:    s.handled.File,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Offset:  s.handled.Offset,
+		Record:  s.handled.Record,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteFile(s.Config.CheckpointFile, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	s.saved = s.handled
+
+	return nil
+}
+
+// removeCheckpoint deletes the checkpoint of a read that went through all files.
+func (s *JSONPlugin) removeCheckpoint() error {
+	if s.Config.CheckpointFile == "" || s.Config.DryRun {
+		return nil
+	}
+	if err := os.Remove(s.Config.CheckpointFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// resumeDecoder starts the decoder at offset of r, between two records of the
+// users array. The array is re-opened in front of the remaining records so that
+// the decoder reads them as if it had been positioned there by Seek.
+func (s *JSONPlugin) resumeDecoder(r io.Reader, offset int64) error {
+	br := bufio.NewReader(r)
+
+	// the separator following the last record read
+	skipped := int64(0)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("cannot resume at offset %d: %w", offset, err)
+		}
+		if strings.ContainsRune(" \t\r\n", rune(c)) {
+			skipped++
+			continue
+		}
+		if c == ',' {
+			skipped++
+		} else if err := br.UnreadByte(); err != nil {
+			return err
+		}
+		break
+	}
+
+	s.decoder = json.NewDecoder(io.MultiReader(strings.NewReader("["), br))
+	if _, err := s.decoder.Token(); err != nil {
+		return err
+	}
+	s.base = offset + skipped - 1
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/filter"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DeleteMatch lists the ids of the users a delete or restore key or filter
+// matched, none when nothing was deleted or restored.
+type DeleteMatch struct {
+	Key     string   `json:"key,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+	Restore bool     `json:"restore,omitempty"`
+	Users   []string `json:"users"`
+}
+
+type deleteReport struct {
+	Matches []*DeleteMatch `json:"matches"`
+}
+
+// DeleteMatches returns the matches of the keys and filters deleted or restored
+// since the plugin was opened, in call order.
+func (s *JSONPlugin) DeleteMatches() []*DeleteMatch {
+	return s.deleteMatches
+}
+
+// DeleteWhere marks the users matching the filter expression as deleted, see
+// filter.Parse for its syntax.
+func (s *JSONPlugin) DeleteWhere(expr string) error {
+	f, err := filter.Parse(expr)
+	if err != nil {
+		return err
+	}
+
+	return s.mark(&DeleteMatch{Filter: expr}, f.Match)
+}
+
+// Restore clears the tombstone of the deleted users matched by key, which is
+// matched like the keys of Delete, and stamps their update time.
+func (s *JSONPlugin) Restore(key string) error {
+	return s.mark(&DeleteMatch{Key: key, Restore: true}, func(user *api.User) (bool, error) {
+		return s.matchesKey(user, key), nil
+	})
+}
+
+// RestoreWhere restores the deleted users matching the filter expression.
+func (s *JSONPlugin) RestoreWhere(expr string) error {
+	f, err := filter.Parse(expr)
+	if err != nil {
+		return err
+	}
+
+	return s.mark(&DeleteMatch{Filter: expr, Restore: true}, f.Match)
+}
+
+// mark deletes or restores the users of from-file selected by matches, recording
+// them in match. The users are written back when the plugin is closed.
+func (s *JSONPlugin) mark(match *DeleteMatch, matches func(*api.User) (bool, error)) error {
+	if s.op != plugin.OperationTypeDelete {
+		return errors.New("delete and restore require a plugin opened for delete")
+	}
+
+	var err error
+	if !s.loaded {
+		err = s.readAll()
+	}
+
+	s.deleteMatches = append(s.deleteMatches, match)
+	for _, user := range s.apiUsers {
+		matched, merr := matches(user)
+		if merr != nil {
+			return merr
+		}
+		if !matched {
+			continue
+		}
+
+		if match.Restore {
+			// users that are not deleted are left alone
+			if !user.Deleted {
+				continue
+			}
+			s.restore(user)
+		} else {
+			s.markDeleted(user)
+		}
+		match.Users = append(match.Users, user.Id)
+	}
+
+	return err
+}
+
+// matchesKey reports whether key designates user under the delete-by setting.
+func (s *JSONPlugin) matchesKey(user *api.User, key string) bool {
+	byEmail := user.Email != "" && strings.EqualFold(user.Email, key)
+	_, byIdentity := user.Identities[key]
+
+	switch s.Config.DeleteBy {
+	case config.DeleteByEmail:
+		return byEmail
+	case config.DeleteByIdentity:
+		return byIdentity
+	case config.DeleteByAny:
+		return user.Id == key || byEmail || byIdentity
+	default:
+		return user.Id == key
+	}
+}
+
+func (s *JSONPlugin) markDeleted(user *api.User) {
+	if user.Metadata == nil {
+		user.Metadata = &api.Metadata{}
+	}
+	user.Deleted = true
+	user.Metadata.DeletedAt = timestamppb.New(s.now().UTC())
+	s.timestamps.Touch(user)
+}
+
+// restore clears the tombstone of user. Unlike a delete the update time is
+// always stamped, so that incremental reads pick the restored user up.
+func (s *JSONPlugin) restore(user *api.User) {
+	if user.Metadata == nil {
+		user.Metadata = &api.Metadata{}
+	}
+	user.Deleted = false
+	user.Metadata.DeletedAt = nil
+	user.Metadata.UpdatedAt = timestamppb.New(s.now().UTC())
+}
+
+// writeDeleteReport writes the matches of the delete to delete-report.
+func (s *JSONPlugin) writeDeleteReport() error {
+	if s.Config.DeleteReport == "" {
+		return nil
+	}
+
+	for _, match := range s.deleteMatches {
+		if match.Users == nil {
+			match.Users = []string{}
+		}
+	}
+
+	b, err := json.MarshalIndent(&deleteReport{Matches: s.deleteMatches}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(s.Config.DeleteReport, bytes.NewBuffer(append(b, '\n')), false)
+}
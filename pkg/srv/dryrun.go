@@ -0,0 +1,91 @@
+package srv
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/atomicfile"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+)
+
+// planFile is the name of the plan summary written to preview-dir.
+const planFile = "dry-run-plan.json"
+
+// PlannedFile is a file a dry run would have written.
+type PlannedFile struct {
+	File  string `json:"file"`
+	Bytes int    `json:"bytes"`
+	// Preview is the file the content was written to instead, if any.
+	Preview string `json:"preview,omitempty"`
+}
+
+// Plan summarizes what a dry run would have done: the users it would have
+// written, deleted and restored and the files it would have written.
+type Plan struct {
+	Written  int            `json:"written"`
+	Deleted  int            `json:"deleted"`
+	Restored int            `json:"restored"`
+	Files    []*PlannedFile `json:"files"`
+	Matches  []*DeleteMatch `json:"matches,omitempty"`
+}
+
+// Plan returns the plan of a dry run once the plugin is closed, nil when the
+// plugin does not dry run.
+func (s *JSONPlugin) Plan() *Plan {
+	return s.plan
+}
+
+// preview returns the file of preview-dir the content of name is written to by
+// a dry run, "" when nothing is written.
+func (s *JSONPlugin) preview(name string) string {
+	if s.Config.PreviewDir == "" {
+		return ""
+	}
+	return filepath.Join(s.Config.PreviewDir, filepath.Base(name))
+}
+
+// finishPlan completes the plan of a dry run, writes it to preview-dir and
+// returns the stats of the users that would have been changed.
+func (s *JSONPlugin) finishPlan() (*plugin.Stats, error) {
+	if !s.Config.DryRun {
+		return nil, nil
+	}
+
+	stats := &plugin.Stats{}
+	switch s.op {
+	case plugin.OperationTypeWrite:
+		s.plan.Written = s.count
+		stats.Received = int32(s.count)
+		stats.Created = int32(s.count)
+	case plugin.OperationTypeDelete:
+		s.plan.Matches = s.deleteMatches
+		deleted, restored := map[string]bool{}, map[string]bool{}
+		for _, match := range s.deleteMatches {
+			for _, id := range match.Users {
+				if match.Restore {
+					restored[id] = true
+				} else {
+					deleted[id] = true
+				}
+			}
+		}
+		s.plan.Deleted, s.plan.Restored = len(deleted), len(restored)
+		stats.Received = int32(len(s.apiUsers))
+		stats.Deleted = int32(len(deleted))
+		stats.Updated = int32(len(restored))
+	}
+
+	if s.Config.PreviewDir == "" {
+		return stats, nil
+	}
+
+	b, err := json.MarshalIndent(s.plan, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(s.Config.PreviewDir, planFile), append(b, '\n'), 0600); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
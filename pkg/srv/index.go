@@ -0,0 +1,274 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/encryption"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+	"github.com/hashicorp/go-multierror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// indexExt is appended to the name of a user file to get the name of its index.
+const indexExt = ".idx"
+
+// buildIndexHint tells how to write a missing or stale index, see BuildIndex.
+const buildIndexHint = "write-index or aserto-idp-json-index"
+
+// span is the position of a record in a user file.
+type span struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// recordIndex locates the records of a user file by user id and identity key.
+// Size and ModTime are those of the file when the index was written, an index
+// not matching them is stale.
+type recordIndex struct {
+	Size       int64             `json:"size"`
+	ModTime    time.Time         `json:"mod_time"`
+	Records    map[string]*span  `json:"records"`
+	Identities map[string]string `json:"identities"`
+
+	// handle is the file the records are read from, opened and verified once
+	handle *os.File
+}
+
+func newRecordIndex() *recordIndex {
+	return &recordIndex{
+		Records:    map[string]*span{},
+		Identities: map[string]string{},
+	}
+}
+
+// add records the position of user. The first record of an id or identity wins,
+// like it does when scanning the file.
+func (x *recordIndex) add(user *api.User, offset, length int64) {
+	if _, ok := x.Records[user.Id]; ok {
+		return
+	}
+	x.Records[user.Id] = &span{Offset: offset, Length: length}
+
+	for key := range user.Identities {
+		if _, ok := x.Identities[key]; !ok {
+			x.Identities[key] = user.Id
+		}
+	}
+}
+
+// find returns the position of the user with id key or, failing that, the
+// identity key.
+func (x *recordIndex) find(key string) (*span, bool) {
+	if sp, ok := x.Records[key]; ok {
+		return sp, true
+	}
+	if id, ok := x.Identities[key]; ok {
+		sp, ok := x.Records[id]
+		return sp, ok
+	}
+	return nil, false
+}
+
+func indexFile(name string) string {
+	return name + indexExt
+}
+
+// writeIndex writes the index of the user file name, whose content was written
+// to the file written, its preview for dry runs.
+func (s *JSONPlugin) writeIndex(name, written string, x *recordIndex) error {
+	info, err := os.Stat(written)
+	if err != nil {
+		return err
+	}
+	x.Size, x.ModTime = info.Size(), info.ModTime()
+
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(indexFile(name), bytes.NewBuffer(append(b, '\n')), false)
+}
+
+// loadIndex reads the index of the user file name and checks that it is current.
+func loadIndex(name string) (*recordIndex, error) {
+	content, err := os.ReadFile(indexFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.FailedPrecondition, "'%s' has no index, write it with %s", name, buildIndexHint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	x := newRecordIndex()
+	if err := json.Unmarshal(content, x); err != nil {
+		return nil, fmt.Errorf("invalid index '%s': %w", indexFile(name), err)
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != x.Size || !info.ModTime().Equal(x.ModTime) {
+		return nil, status.Errorf(codes.FailedPrecondition, "'%s' changed after its index was written, rebuild it with %s", name, buildIndexHint)
+	}
+
+	return x, nil
+}
+
+// BuildIndex reads the from-file of conf and writes the index of every file read.
+// Files with records that cannot be read are not indexed, the errors of their
+// records are returned.
+func BuildIndex(conf *config.JSONPluginConfig) error {
+	if conf.Format == config.FormatLDIF {
+		return errors.New("the ldif format does not support indexes")
+	}
+
+	// the index covers every user, not the ones changed since the last read
+	c := *conf
+	c.Since, c.WatermarkFile, c.CheckpointFile = "", "", ""
+
+	files, err := c.SourceFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		encrypted, err := encryption.IsEncrypted(file)
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			return fmt.Errorf("'%s' is encrypted and cannot be indexed", file)
+		}
+	}
+
+	s := NewJSONPlugin()
+	if err := s.Open(&c, plugin.OperationTypeRead); err != nil {
+		return err
+	}
+	defer s.Close() // nolint:errcheck // read stats are not used
+
+	var errs error
+	indexes := map[string]*recordIndex{}
+	for {
+		users, err := s.readNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		file := s.fileStats[len(s.fileStats)-1].File
+		x, ok := indexes[file]
+		if !ok {
+			x = newRecordIndex()
+			indexes[file] = x
+		}
+		for _, user := range users {
+			x.add(user, s.offset-s.length, s.length)
+		}
+	}
+
+	for _, stats := range s.fileStats {
+		x := indexes[stats.File]
+		if len(stats.Errors) > 0 {
+			continue
+		}
+		if x == nil {
+			x = newRecordIndex()
+		}
+		if err := s.writeIndex(stats.File, stats.File, x); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// GetUser returns the user with id key or, failing that, with the identity key,
+// reading its record directly at the position given by the index of the source
+// files. The plugin must be opened for read.
+func (s *JSONPlugin) GetUser(key string) (*api.User, error) {
+	if s.op != plugin.OperationTypeRead {
+		return nil, errors.New("get user requires a plugin opened for read")
+	}
+
+	for _, file := range s.files {
+		x, ok := s.indexes[file]
+		if !ok {
+			var err error
+			if x, err = loadIndex(file); err != nil {
+				return nil, err
+			}
+			s.indexes[file] = x
+		}
+
+		sp, ok := x.find(key)
+		if !ok {
+			continue
+		}
+
+		user, err := s.readAt(file, x, sp)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.readTransforms.Apply(user); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "user '%s' not found", key)
+}
+
+// readAt reads the record of file at sp. The file is opened on the first read
+// and, when a verify key is configured, its signature is checked then: the index
+// does not vouch for the content of the file. Later reads use the same handle,
+// which holds the content verified even if the file is replaced meanwhile.
+func (s *JSONPlugin) readAt(file string, x *recordIndex, sp *span) (*api.User, error) {
+	if x.handle == nil {
+		f, err := s.openVerified(file)
+		if err != nil {
+			return nil, err
+		}
+		// the content verified must be the content indexed
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.Size() != x.Size || !info.ModTime().Equal(x.ModTime) {
+			f.Close()
+			return nil, status.Errorf(codes.FailedPrecondition, "'%s' changed after its index was written, rebuild it with %s", file, buildIndexHint)
+		}
+		x.handle = f
+	}
+
+	b := make([]byte, sp.Length)
+	if _, err := x.handle.ReadAt(b, sp.Offset); err != nil {
+		return nil, fmt.Errorf("'%s': cannot read the record at offset %d: %w", file, sp.Offset, err)
+	}
+
+	return s.unmarshal(b)
+}
+
+// closeIndexes closes the files opened to read the records of the indexes.
+func (s *JSONPlugin) closeIndexes() {
+	for _, x := range s.indexes {
+		if x.handle != nil {
+			x.handle.Close()
+			x.handle = nil
+		}
+	}
+}
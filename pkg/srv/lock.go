@@ -0,0 +1,40 @@
+package srv
+
+import (
+	"errors"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/filelock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lock takes the lock of the file a write or delete rewrites, so that concurrent
+// invocations do not overwrite each other's changes. Dry runs rewrite nothing
+// and take no lock.
+func (s *JSONPlugin) lock(name string) error {
+	if s.Config.DryRun {
+		return nil
+	}
+
+	wait, err := s.Config.LockWait()
+	if err != nil {
+		return err
+	}
+
+	lock, err := filelock.Acquire(name, wait)
+	if errors.Is(err, filelock.ErrLocked) {
+		return status.Errorf(codes.Unavailable, "'%s' is locked by another invocation, gave up after %s", name, wait)
+	}
+	if err != nil {
+		return err
+	}
+	s.fileLock = lock
+
+	return nil
+}
+
+func (s *JSONPlugin) unlock() error {
+	err := s.fileLock.Release()
+	s.fileLock = nil
+	return err
+}
@@ -0,0 +1,230 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/encryption"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/extra"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/jsonpath"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/ldif"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/profile"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/signature"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/transform"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FileStats holds the read counters of a single source file.
+type FileStats struct {
+	File     string
+	Received int32
+	Errors   []error
+	// GeneratedIDs and DerivedIDs count the users read without an id that were
+	// given a random one or one derived from an identity.
+	GeneratedIDs int32
+	DerivedIDs   int32
+	// Skipped counts the users that did not change after the since time.
+	Skipped int32
+}
+
+// FileStats returns the counters of the source files opened so far, in read order.
+func (s *JSONPlugin) FileStats() []*FileStats {
+	return s.fileStats
+}
+
+// nextFile closes the current source file and opens the next one, returning
+// io.EOF when all files have been read.
+func (s *JSONPlugin) nextFile() error {
+	s.closeFile()
+
+	if len(s.fileStats) == len(s.files) {
+		s.completed = true
+		return io.EOF
+	}
+
+	name := s.files[len(s.fileStats)]
+	stats := &FileStats{File: name}
+	s.fileStats = append(s.fileStats, stats)
+
+	if err := s.openFile(name); err != nil {
+		s.closeFile()
+		stats.Errors = append(stats.Errors, err)
+		return err
+	}
+
+	return nil
+}
+
+// openVerified opens the file name and, when a verify key is configured, checks
+// its signature against the content of the returned handle, so that the content
+// read is the content verified even if the file is replaced meanwhile.
+func (s *JSONPlugin) openVerified(name string) (*os.File, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.verifyKey == nil {
+		return file, nil
+	}
+
+	if err := signature.VerifyReader(name, file, s.verifyKey); err != nil {
+		file.Close()
+		return nil, status.Errorf(codes.PermissionDenied, "'%s' failed signature verification: %s", name, err.Error())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (s *JSONPlugin) openFile(name string) error {
+	var resume *checkpoint
+	if s.resume != nil && s.resume.File == name {
+		resume, s.resume = s.resume, nil
+	}
+	s.record, s.offset, s.base = 0, 0, 0
+
+	file, err := s.openVerified(name)
+	if err != nil {
+		return err
+	}
+	s.file = file
+
+	// plaintext files are resumed by seeking, encrypted ones by decrypting up to the offset
+	encrypted := false
+	if resume != nil {
+		if encrypted, err = encryption.IsEncrypted(name); err != nil {
+			return err
+		}
+		if !encrypted {
+			if _, err := file.Seek(resume.Offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	r, err := s.keys.Reader(file)
+	if err != nil {
+		return fmt.Errorf("'%s': %w", name, err)
+	}
+
+	if s.Config.Format == config.FormatLDIF {
+		s.ldifReader = ldif.NewReader(r)
+		return nil
+	}
+
+	if resume != nil {
+		if encrypted {
+			if _, err := io.CopyN(io.Discard, r, resume.Offset); err != nil {
+				return fmt.Errorf("'%s': cannot resume at offset %d: %w", name, resume.Offset, err)
+			}
+		}
+		s.record, s.offset = resume.Record, resume.Offset
+		return s.resumeDecoder(r, resume.Offset)
+	}
+
+	s.decoder = json.NewDecoder(r)
+
+	if err := jsonpath.Seek(s.decoder, s.path); err != nil {
+		return fmt.Errorf("'%s': %w", name, err)
+	}
+	return nil
+}
+
+// readContent returns the decrypted content of the file.
+func (s *JSONPlugin) readContent(name string) ([]byte, error) {
+	file, err := s.openVerified(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := s.keys.Reader(file)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", name, err)
+	}
+
+	return io.ReadAll(r)
+}
+
+func (s *JSONPlugin) closeFile() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.ldifReader = nil
+}
+
+// readFile returns the next user of the current source file, or io.EOF when the
+// file is exhausted.
+func (s *JSONPlugin) readFile() ([]*api.User, error) {
+	if s.ldifReader != nil {
+		entry, err := s.ldifReader.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		return []*api.User{s.attrMap.ToUser(entry)}, nil
+	}
+
+	if s.file == nil {
+		return nil, io.EOF
+	}
+
+	if s.decoder.More() {
+		var b json.RawMessage
+		if err := s.decoder.Decode(&b); err != nil {
+			// the decoder cannot recover from malformed input, skip the rest of the file
+			s.closeFile()
+			return nil, err
+		}
+		s.record++
+		s.offset = s.base + s.decoder.InputOffset()
+		s.length = int64(len(b))
+
+		u, err := s.unmarshal(b)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*api.User{u}, nil
+	}
+	if _, err := s.decoder.Token(); err != nil {
+		s.closeFile()
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// unmarshal converts a JSON record of the source profile to a user.
+func (s *JSONPlugin) unmarshal(b []byte) (*api.User, error) {
+	if s.inferKinds && s.profile.Name == profile.Aserto {
+		cleared, err := transform.ClearEmptyKinds(b)
+		if err != nil {
+			return nil, err
+		}
+		b = cleared
+	}
+
+	if s.Config.PreserveUnknown && s.profile.Name == profile.Aserto {
+		u := &api.User{}
+		fields, err := extra.Unmarshal(b, u)
+		if err != nil {
+			return nil, err
+		}
+		if fields != nil && s.unknown != nil {
+			s.unknown[u] = fields
+		}
+		return u, nil
+	}
+
+	return s.profile.Unmarshal(b)
+}
@@ -0,0 +1,363 @@
+package srv
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/encryption"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultSortBuffer is the number of users sorted in memory before they are
+// spilled to a temporary file.
+const defaultSortBuffer = 10000
+
+// defaultMergeFanIn is the number of spill files merged at once, which bounds the
+// files open while merging.
+const defaultMergeFanIn = 64
+
+// sorter orders the written users with an external merge sort: runs of at most
+// buffer users are sorted in memory and spilled to temporary files, which are
+// merged when the output is written. Spills beyond fanIn are merged in passes.
+type sorter struct {
+	by     string
+	buffer int
+	fanIn  int
+	run    []*api.User
+	dir    string
+	spills []string
+	// created numbers the spill files
+	created int
+	// keys encrypt the spills when the output is encrypted
+	keys *encryption.Keys
+}
+
+func newSorter(by string, buffer int, encrypt bool) (*sorter, error) {
+	if buffer <= 0 {
+		buffer = defaultSortBuffer
+	}
+	s := &sorter{by: by, buffer: buffer, fanIn: defaultMergeFanIn}
+
+	if encrypt {
+		keys, err := encryption.Ephemeral()
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+	}
+
+	return s, nil
+}
+
+// sortKey returns the value users are ordered by, timestamps are formatted so
+// that they compare lexically.
+func sortKey(user *api.User, by string) string {
+	switch by {
+	case config.SortByEmail:
+		return user.Email
+	case config.SortByDisplayName:
+		return user.DisplayName
+	case config.SortByCreatedAt:
+		if user.GetMetadata().GetCreatedAt() == nil {
+			return ""
+		}
+		return user.Metadata.CreatedAt.AsTime().UTC().Format("2006-01-02T15:04:05.000000000Z")
+	default:
+		return user.Id
+	}
+}
+
+func (s *sorter) less(a, b *api.User) bool {
+	ka, kb := sortKey(a, s.by), sortKey(b, s.by)
+	if ka != kb {
+		return ka < kb
+	}
+	return a.Id < b.Id
+}
+
+func (s *sorter) add(user *api.User) error {
+	s.run = append(s.run, user)
+	if len(s.run) < s.buffer {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill sorts the current run and writes it to a temporary file.
+func (s *sorter) spill() error {
+	sort.SliceStable(s.run, func(i, j int) bool { return s.less(s.run[i], s.run[j]) })
+
+	w, err := s.createSpill()
+	if err != nil {
+		return err
+	}
+	s.spills = append(s.spills, w.name)
+	for _, user := range s.run {
+		if err := w.write(user); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	s.run = nil
+
+	return w.close()
+}
+
+// spillWriter writes users to a spill file as length prefixed protobuf records.
+type spillWriter struct {
+	name      string
+	file      *os.File
+	encrypted io.WriteCloser
+	w         *bufio.Writer
+	prefix    []byte
+}
+
+func (s *sorter) createSpill() (*spillWriter, error) {
+	if s.dir == "" {
+		dir, err := os.MkdirTemp("", "idp-json-sort-")
+		if err != nil {
+			return nil, err
+		}
+		s.dir = dir
+	}
+
+	name := filepath.Join(s.dir, fmt.Sprintf("run-%04d", s.created))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.created++
+
+	sw := &spillWriter{name: name, file: file, prefix: make([]byte, binary.MaxVarintLen64)}
+	var w io.Writer = file
+	if s.keys != nil {
+		if sw.encrypted, err = s.keys.Encrypt(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		w = sw.encrypted
+	}
+	sw.w = bufio.NewWriter(w)
+
+	return sw, nil
+}
+
+func (sw *spillWriter) write(user *api.User) error {
+	b, err := proto.Marshal(user)
+	if err != nil {
+		return err
+	}
+	n := binary.PutUvarint(sw.prefix, uint64(len(b)))
+	if _, err := sw.w.Write(sw.prefix[:n]); err != nil {
+		return err
+	}
+	_, err = sw.w.Write(b)
+	return err
+}
+
+func (sw *spillWriter) close() error {
+	if err := sw.w.Flush(); err != nil {
+		sw.file.Close()
+		return err
+	}
+	if sw.encrypted != nil {
+		if err := sw.encrypted.Close(); err != nil {
+			sw.file.Close()
+			return err
+		}
+	}
+	return sw.file.Close()
+}
+
+// run is a sorted sequence of users being merged.
+type run struct {
+	index  int
+	user   *api.User
+	users  []*api.User
+	reader *bufio.Reader
+	file   *os.File
+}
+
+func (r *run) next() error {
+	if r.reader == nil {
+		if len(r.users) == 0 {
+			r.user = nil
+			return nil
+		}
+		r.user, r.users = r.users[0], r.users[1:]
+		return nil
+	}
+
+	size, err := binary.ReadUvarint(r.reader)
+	if errors.Is(err, io.EOF) {
+		r.user = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return err
+	}
+	user := &api.User{}
+	if err := proto.Unmarshal(b, user); err != nil {
+		return err
+	}
+	r.user = user
+
+	return nil
+}
+
+type runHeap struct {
+	runs   []*run
+	sorter *sorter
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.runs[i], h.runs[j]
+	if h.sorter.less(a.user, b.user) {
+		return true
+	}
+	if h.sorter.less(b.user, a.user) {
+		return false
+	}
+	// equal users keep the order they were written in
+	return a.index < b.index
+}
+
+func (h *runHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*run)) }
+
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
+
+// each calls fn with the added users in sorted order.
+func (s *sorter) each(fn func(*api.User) error) error {
+	// merge the first spills into one until they can all be open at once
+	for len(s.spills) > s.fanIn {
+		if err := s.mergeSpills(s.fanIn); err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(s.run, func(i, j int) bool { return s.less(s.run[i], s.run[j]) })
+
+	return s.merge(s.spills, s.run, fn)
+}
+
+// mergeSpills replaces the first n spills with a single one. The merged spill
+// comes first, so that equal users keep the order they were written in.
+func (s *sorter) mergeSpills(n int) error {
+	w, err := s.createSpill()
+	if err != nil {
+		return err
+	}
+	if err := s.merge(s.spills[:n], nil, w.write); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	for _, name := range s.spills[:n] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	s.spills = append([]string{w.name}, s.spills[n:]...)
+
+	return nil
+}
+
+// merge calls fn with the users of the spills and of the sorted users in order.
+func (s *sorter) merge(spills []string, users []*api.User, fn func(*api.User) error) error {
+	h := &runHeap{sorter: s}
+	defer func() {
+		for _, r := range h.runs {
+			if r.file != nil {
+				r.file.Close()
+			}
+		}
+	}()
+
+	for i, name := range spills {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		r := &run{index: i, file: file}
+		h.runs = append(h.runs, r)
+
+		reader, err := s.keys.Reader(file)
+		if err != nil {
+			return err
+		}
+		r.reader = bufio.NewReader(reader)
+	}
+	h.runs = append(h.runs, &run{index: len(spills), users: users})
+
+	live := h.runs[:0:0]
+	for _, r := range h.runs {
+		if err := r.next(); err != nil {
+			return err
+		}
+		if r.user != nil {
+			live = append(live, r)
+		} else if r.file != nil {
+			r.file.Close()
+			r.file = nil
+		}
+	}
+	h.runs = live
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		r := h.runs[0]
+		if err := fn(r.user); err != nil {
+			return err
+		}
+		if err := r.next(); err != nil {
+			return err
+		}
+		if r.user == nil {
+			heap.Pop(h)
+			if r.file != nil {
+				r.file.Close()
+				r.file = nil
+			}
+			continue
+		}
+		heap.Fix(h, 0)
+	}
+
+	return nil
+}
+
+// cleanup removes the spill files.
+func (s *sorter) cleanup() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+		s.dir = ""
+	}
+	s.spills = nil
+	s.created = 0
+	s.run = nil
+}
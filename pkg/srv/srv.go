@@ -1,21 +1,28 @@
 package srv
 
 import (
-	"bufio"
-	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"time"
 
 	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/encryption"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/extra"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/filelock"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/jsonpath"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/ldif"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/profile"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/signature"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/transform"
 	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
-	"github.com/aserto-dev/idp-plugin-sdk/pb"
 	"github.com/aserto-dev/idp-plugin-sdk/plugin"
 	"github.com/hashicorp/go-multierror"
 	"google.golang.org/protobuf/encoding/protojson"
-	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/proto"
 )
 
 var jsonOptions = protojson.MarshalOptions{
@@ -28,17 +35,86 @@ var jsonOptions = protojson.MarshalOptions{
 }
 
 type JSONPlugin struct {
-	Config   *config.JSONPluginConfig
+	Config *config.JSONPluginConfig
+	// Now returns the time stamped on written and deleted users.
+	Now func() time.Time
+
 	decoder  *json.Decoder
-	users    bytes.Buffer
+	profile  *profile.Profile
+	path     []string
 	op       plugin.OperationType
+	opened   bool
 	apiUsers []*api.User
+	loaded   bool
 	count    int
+
+	attrMap    *ldif.AttributeMap
+	ldifReader *ldif.Reader
+
+	marshalOptions protojson.MarshalOptions
+
+	sorter     *sorter
+	out        *output
+	partitions map[string]*output
+	shardBy    []string
+	shards     []*shard
+	partNames  map[string]string
+	partTaken  map[string]bool
+
+	files     []string
+	file      *os.File
+	fileStats []*FileStats
+	since     time.Time
+	newest    time.Time
+
+	// resume is the checkpoint the read continues from, record and offset the
+	// position reached in the current file, length the size of the last record
+	// and base the file offset of the start of the decoder input.
+	resume    *checkpoint
+	record    int64
+	offset    int64
+	length    int64
+	base      int64
+	completed bool
+
+	// returned is the position after the last record returned by Read, handled
+	// the one after the last record the caller is known to have handled and
+	// saved the one of the last checkpoint written. A read that failed is not
+	// handled past the failed record, so that a resumed read retries it.
+	returned checkpoint
+	handled  checkpoint
+	saved    checkpoint
+	failed   bool
+
+	indexes map[string]*recordIndex
+
+	keys       *encryption.Keys
+	signingKey ed25519.PrivateKey
+	verifyKey  ed25519.PublicKey
+
+	readTransforms  transform.Chain
+	writeTransforms transform.Chain
+	inferKinds      bool
+	ids             *transform.IDAssigner
+	timestamps      *transform.Timestamps
+	redactor        *transform.Redactor
+	// replaced holds the users of the to-file a write replaces by id
+	replaced map[string]*replacedUser
+
+	// unknown holds the fields of the deleted file records that are not part of a user
+	unknown map[*api.User]extra.Fields
+
+	deleteMatches []*DeleteMatch
+	plan          *Plan
+
+	// fileLock is held on the file rewritten by a write or delete
+	fileLock *filelock.Lock
 }
 
 func NewJSONPlugin() *JSONPlugin {
 	return &JSONPlugin{
 		Config: &config.JSONPluginConfig{},
+		Now:    time.Now,
 	}
 }
 
@@ -50,63 +126,273 @@ func (s *JSONPlugin) GetVersion() (string, string, string) {
 	return config.GetVersion()
 }
 
-func (s *JSONPlugin) Open(cfg plugin.Config, operation plugin.OperationType) error {
+func (s *JSONPlugin) Open(cfg plugin.Config, operation plugin.OperationType) (err error) {
 	conf, ok := cfg.(*config.JSONPluginConfig)
 	if !ok {
 		return errors.New("invalid config")
 	}
+
+	// the lock taken for write and delete is released by Close, or here when
+	// the plugin cannot be opened
+	if err := s.unlock(); err != nil {
+		return err
+	}
+	s.opened = false
+	defer func() {
+		if err != nil {
+			s.unlock() // nolint:errcheck // the open error is reported
+			return
+		}
+		s.opened = true
+	}()
+
 	s.Config = conf
 	s.count = 0
+	s.marshalOptions = s.newMarshalOptions()
+	s.plan = nil
+	if s.Config.DryRun {
+		s.plan = &Plan{Files: []*PlannedFile{}}
+		if s.Config.PreviewDir != "" {
+			if err := s.Config.ValidatePreviewDir(operation); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(s.Config.PreviewDir, 0700); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.Config.Format == config.FormatLDIF {
+		if operation == plugin.OperationTypeDelete {
+			return errors.New("the ldif format does not support delete")
+		}
+		attrMap, err := ldif.ParseAttributeMap(s.Config.LDIFAttributeMap)
+		if err != nil {
+			return err
+		}
+		s.attrMap = attrMap
+	}
+
+	keys, err := s.Config.Keys()
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+
+	s.signingKey, s.verifyKey = nil, nil
+	if s.Config.SigningKeyFile != "" {
+		if s.signingKey, err = signature.LoadPrivateKey(s.Config.SigningKeyFile); err != nil {
+			return err
+		}
+	}
+	if s.Config.VerifyKeyFile != "" {
+		if s.verifyKey, err = signature.LoadPublicKey(s.Config.VerifyKeyFile); err != nil {
+			return err
+		}
+	}
+
+	p, ok := profile.Get(s.Config.Profile)
+	if !ok {
+		return fmt.Errorf("unknown profile '%s'", s.Config.Profile)
+	}
+	s.profile = p
+
+	usersPath := s.Config.UsersPath
+	if usersPath == "" {
+		usersPath = p.UsersPath
+	}
+	path, err := jsonpath.Parse(usersPath)
+	if err != nil {
+		return err
+	}
+	s.path = path
+
+	normalizer, err := s.Config.Normalizer()
+	if err != nil {
+		return err
+	}
+	s.inferKinds = normalizer.InfersKind()
+
+	if s.ids, err = s.Config.IDAssigner(); err != nil {
+		return err
+	}
+
+	s.timestamps = &transform.Timestamps{Fill: s.Config.FillTimestamps, Now: s.now}
+
+	transforms := transform.Chain{normalizer, s.ids}
+	roleMapper, err := s.Config.RoleMapper()
+	if err != nil {
+		return err
+	}
+	if roleMapper != nil {
+		transforms = append(transforms, roleMapper)
+	}
 
 	s.op = operation
 	switch operation {
 	case plugin.OperationTypeWrite:
 
-		s.users.Write([]byte("[\n"))
-
-	case plugin.OperationTypeRead, plugin.OperationTypeDelete:
+		if err := s.lock(s.Config.ToFile); err != nil {
+			return err
+		}
 
-		file, err := os.Open(s.Config.FromFile)
+		shardBy, err := jsonpath.Parse(s.Config.ShardBy)
 		if err != nil {
 			return err
 		}
+		s.shardBy = shardBy
 
-		s.decoder = json.NewDecoder(file)
+		if s.redactor, err = s.Config.Redactor(); err != nil {
+			return err
+		}
+		// redaction follows normalization so that equal identities hash equally
+		s.writeTransforms = append(transforms, s.timestamps, s.redactor)
+		s.abortOutputs()
+		s.partitions = map[string]*output{}
+		s.shards = nil
+		s.partNames, s.partTaken = map[string]string{}, map[string]bool{}
+		s.out = nil
 
-		if _, err = s.decoder.Token(); err != nil {
+		if s.replaced, err = s.loadReplaced(); err != nil {
 			return err
 		}
+
+		s.sorter = nil
+		if s.Config.SortBy != "" {
+			if s.sorter, err = newSorter(s.Config.SortBy, s.Config.SortBuffer, s.keys.CanEncrypt()); err != nil {
+				return err
+			}
+		}
+
+	case plugin.OperationTypeRead, plugin.OperationTypeDelete:
+
+		files, err := s.Config.SourceFiles()
+		if err != nil {
+			return err
+		}
+		if operation == plugin.OperationTypeDelete {
+			if len(files) != 1 {
+				return errors.New("delete requires a single file")
+			}
+			if err := s.lock(files[0]); err != nil {
+				return err
+			}
+		}
+		s.files = files
+		s.apiUsers, s.loaded = nil, false
+		// delete writes the records back as they are, only invalid timestamps
+		// that could not be written are fixed
+		s.readTransforms = transform.Chain{&transform.Timestamps{}}
+		if operation == plugin.OperationTypeRead {
+			s.readTransforms = append(transforms, &transform.Timestamps{})
+		}
+		s.unknown = nil
+		if s.Config.PreserveUnknown && operation == plugin.OperationTypeDelete {
+			s.unknown = map[*api.User]extra.Fields{}
+		}
+		s.fileStats = make([]*FileStats, 0, len(files))
+		s.deleteMatches = nil
+
+		s.since, s.newest = time.Time{}, time.Time{}
+		s.resume, s.completed = nil, false
+		s.returned, s.handled, s.saved, s.failed = checkpoint{}, checkpoint{}, checkpoint{}, false
+		s.closeIndexes()
+		s.indexes = map[string]*recordIndex{}
+		if operation == plugin.OperationTypeRead {
+			if s.since, err = s.Config.ChangedSince(); err != nil {
+				return err
+			}
+			if s.Config.CheckpointFile != "" {
+				if s.resume, err = s.loadCheckpoint(); err != nil {
+					return err
+				}
+				if s.resume != nil {
+					s.handled = checkpoint{File: s.resume.File, Offset: s.resume.Offset, Record: s.resume.Record}
+					s.returned, s.saved = s.handled, s.handled
+				}
+			}
+		}
+
+		return s.nextFile()
 	}
 
 	return nil
 }
 
 func (s *JSONPlugin) Read() ([]*api.User, error) {
-	if s.decoder.More() {
-		u := api.User{}
-		if err := pb.UnmarshalNext(s.decoder, &u); err != nil {
+	// the users returned so far have been handled by the caller
+	if !s.failed {
+		s.handled = s.returned
+	}
+	if err := s.saveCheckpoint(false); err != nil {
+		return nil, err
+	}
+
+	for {
+		users, err := s.readNext()
+		if err == io.EOF {
+			return nil, err
+		}
+		if err != nil {
+			s.failed = true
 			return nil, err
 		}
+		if users = s.changed(users); len(users) > 0 {
+			s.returned = checkpoint{File: s.fileStats[len(s.fileStats)-1].File, Offset: s.offset, Record: s.record}
+			return users, nil
+		}
+	}
+}
 
-		return []*api.User{&u}, nil
+// readNext returns the next users of the source files.
+func (s *JSONPlugin) readNext() ([]*api.User, error) {
+	users, err := s.readFile()
+	for err == io.EOF {
+		if err = s.nextFile(); err != nil {
+			return nil, err
+		}
+		users, err = s.readFile()
 	}
-	if _, err := s.decoder.Token(); err != nil {
+
+	stats := s.fileStats[len(s.fileStats)-1]
+	if err != nil {
+		stats.Errors = append(stats.Errors, err)
 		return nil, err
 	}
+	stats.Received += int32(len(users))
+
+	generated, derived := s.ids.Generated, s.ids.Derived
+	for _, user := range users {
+		if err := s.readTransforms.Apply(user); err != nil {
+			stats.Errors = append(stats.Errors, err)
+			return nil, err
+		}
+	}
+	stats.GeneratedIDs += s.ids.Generated - generated
+	stats.DerivedIDs += s.ids.Derived - derived
 
-	return nil, io.EOF
+	return users, nil
 }
 
 func (s *JSONPlugin) Write(user *api.User) error {
-	if s.count != 0 {
-		_, _ = s.users.Write([]byte(",\n"))
-	}
-	b, err := jsonOptions.Marshal(user)
-	if err != nil {
+	user = proto.Clone(user).(*api.User)
+	stamped := user.GetMetadata().GetCreatedAt() != nil || user.GetMetadata().GetUpdatedAt() != nil
+	if err := s.writeTransforms.Apply(user); err != nil {
 		return err
 	}
+	if r, ok := s.replaced[user.Id]; ok {
+		r.stamp(user, stamped, s.timestamps)
+	}
 
-	if _, err := s.users.Write(b); err != nil {
+	if s.sorter != nil {
+		if err := s.sorter.add(user); err != nil {
+			return err
+		}
+		s.count++
+		return nil
+	}
+
+	if err := s.writeUser(user); err != nil {
 		return err
 	}
 	s.count++
@@ -114,68 +400,178 @@ func (s *JSONPlugin) Write(user *api.User) error {
 	return nil
 }
 
-func (s *JSONPlugin) Delete(userID string) error {
-
-	var err error
-	if len(s.apiUsers) == 0 {
-		err = s.readAll()
+func (s *JSONPlugin) writeUser(user *api.User) error {
+	out, err := s.outputFor(user)
+	if err != nil {
+		return err
 	}
 
-	for _, user := range s.apiUsers {
-		if user.Id == userID {
-			user.Deleted = true
-			user.Metadata.DeletedAt = timestamppb.New(time.Now())
-		}
-	}
+	return s.write(out, user)
+}
+
+// AssignedIDs returns the number of users given a random id and the number given
+// an id derived from an identity since the plugin was opened.
+func (s *JSONPlugin) AssignedIDs() (generated, derived int32) {
+	return s.ids.Generated, s.ids.Derived
+}
 
-	return err
+// Delete marks the users matched by key as deleted, or restores them when
+// restore is set. Keys are matched against the user id unless delete-by selects
+// the email or the identity keys.
+func (s *JSONPlugin) Delete(key string) error {
+	return s.mark(&DeleteMatch{Key: key, Restore: s.Config.Restore}, func(user *api.User) (bool, error) {
+		return s.matchesKey(user, key), nil
+	})
 }
 
 func (s *JSONPlugin) Close() (*plugin.Stats, error) {
+	// Close is called after a failed Open too, it must not rewrite the files
+	// of an operation that never started
+	s.closeIndexes()
+	if !s.opened {
+		s.closeFile()
+		s.abort()
+		return nil, nil
+	}
+	s.opened = false
+
+	// from-file is rewritten with all its users, even when none was deleted
+	if s.op == plugin.OperationTypeDelete && !s.loaded {
+		s.readAll() // nolint:errcheck // the errors are in the file stats
+	}
+	s.closeFile()
+	defer s.unlock() // nolint:errcheck // the lock is released when the file is closed anyway
+
 	switch s.op {
-	case plugin.OperationTypeWrite, plugin.OperationTypeDelete:
-
-		file := s.Config.ToFile
-		if s.op == plugin.OperationTypeDelete {
-			file = s.Config.FromFile
-			s.users.Reset()
-			s.users.Write([]byte("[\n"))
-
-			for _, user := range s.apiUsers {
-				err := s.Write(user)
-				if err != nil {
-					return nil, err
-				}
+	case plugin.OperationTypeRead:
+		stats := &plugin.Stats{}
+		for _, fs := range s.fileStats {
+			stats.Received += fs.Received
+			stats.Errors += int32(len(fs.Errors))
+		}
+		// an interrupted read continues after the last user handled
+		if s.completed {
+			if err := s.removeCheckpoint(); err != nil {
+				return nil, err
 			}
+		} else if err := s.saveCheckpoint(true); err != nil {
+			return nil, err
 		}
-		_, err := s.users.Write([]byte("\n]\n"))
-		if err != nil {
+		// records are not in change order, a read that stopped early may not
+		// have seen users older than the newest one returned
+		if s.completed && stats.Errors == 0 {
+			if err := s.saveWatermark(); err != nil {
+				return nil, err
+			}
+		}
+		return stats, nil
+	case plugin.OperationTypeWrite:
+		defer s.abortOutputs()
+		if s.sorter != nil {
+			defer s.sorter.cleanup()
+			if err := s.sorter.each(s.writeUser); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.finishAll(); err != nil {
 			return nil, err
 		}
-		f, err := os.Create(file)
+		return s.finishPlan()
+	case plugin.OperationTypeDelete:
+
+		if s.Config.DeleteFilter != "" {
+			mark := s.DeleteWhere
+			if s.Config.Restore {
+				mark = s.RestoreWhere
+			}
+			if err := mark(s.Config.DeleteFilter); err != nil {
+				return nil, err
+			}
+		}
+
+		// the records that could not be read would be dropped by the rewrite
+		for _, fs := range s.fileStats {
+			if len(fs.Errors) > 0 {
+				return nil, fmt.Errorf("'%s' is not rewritten, %d of its records could not be read: %w",
+					fs.File, len(fs.Errors), fs.Errors[0])
+			}
+		}
+
+		file := s.Config.FromFile
+
+		// the original document is the template of the rewritten one
+		var template []byte
+		if len(s.path) > 0 {
+			content, err := s.readContent(file)
+			if err != nil {
+				return nil, err
+			}
+			template = content
+		}
+
+		out, err := s.newOutput(file, "", template)
 		if err != nil {
 			return nil, err
 		}
-		w := bufio.NewWriter(f)
-		_, err = s.users.WriteTo(w)
-		if err != nil {
+		defer out.users.abort()
+
+		for _, user := range s.apiUsers {
+			err := s.write(out, user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := s.finish(out); err != nil {
+			return nil, err
+		}
+
+		if err := s.writeDeleteReport(); err != nil {
 			return nil, err
 		}
-		w.Flush()
+		return s.finishPlan()
 	}
 	return nil, nil
 }
 
+// ReadUsers reads all users of the from-file of conf. The users of the records
+// that could be read are returned along with the errors of the others.
+func ReadUsers(conf *config.JSONPluginConfig) ([]*api.User, error) {
+	// all users are read, without moving the watermark or checkpoint of conf
+	c := *conf
+	c.Since, c.WatermarkFile, c.CheckpointFile = "", "", ""
+
+	s := NewJSONPlugin()
+	if err := s.Open(&c, plugin.OperationTypeRead); err != nil {
+		return nil, err
+	}
+
+	errs := s.readAll()
+	if _, err := s.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return s.apiUsers, errs
+}
+
+func (s *JSONPlugin) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
 func (s *JSONPlugin) readAll() error {
+	s.loaded = true
+
 	var errs error
 	users, err := s.Read()
 	for err != io.EOF {
 		if err != nil {
 			errs = multierror.Append(errs, err)
-			continue
+		} else {
+			s.apiUsers = append(s.apiUsers, users...)
 		}
-
-		s.apiUsers = append(s.apiUsers, users...)
 		users, err = s.Read()
 	}
 
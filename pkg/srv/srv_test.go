@@ -1,6 +1,13 @@
 package srv
 
 import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -9,10 +16,16 @@ import (
 	"testing"
 	"time"
 
+	"filippo.io/age"
 	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/diff"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/filelock"
 	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
 	"github.com/aserto-dev/idp-plugin-sdk/plugin"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -115,6 +128,10 @@ func TestOpenForWriteInexistingFile(t *testing.T) {
 
 	err := JSONplugin.Open(&conf, plugin.OperationTypeWrite)
 	assert.Nil(err)
+
+	// opening for write locks the file
+	assert.True(FileExists(filelock.File(conf.ToFile)))
+	assert.Nil(os.Remove(filelock.File(conf.ToFile)))
 }
 
 func TestReadTwoUsers(t *testing.T) {
@@ -225,6 +242,8 @@ func TestDelete(t *testing.T) {
 
 	err = os.Remove(copyFilePath)
 	assert.Nil(err)
+	err = os.RemoveAll(filelock.File(copyFilePath))
+	assert.Nil(err)
 }
 
 func TestWrite(t *testing.T) {
@@ -263,4 +282,2137 @@ func TestWrite(t *testing.T) {
 
 	err = os.Remove(filePath)
 	assert.Nil(err)
+	err = os.RemoveAll(filelock.File(filePath))
+	assert.Nil(err)
+}
+
+func TestReadOktaProfile(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "okta-users.json")
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+		Profile:  "okta",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Isaac Brock", user[0].DisplayName)
+
+	user, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Ann Lee", user[0].DisplayName)
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+}
+
+func TestReadAzureADProfile(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "azuread-users.json")
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+		Profile:  "azuread",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Adele Vance", user[0].DisplayName)
+	assert.Equal("5bde3e51-d13b-4db1-9948-fe4b109d11a7", user[0].Attributes.Properties.Fields["manager"].GetStringValue())
+
+	user, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Miriam Graham", user[0].DisplayName)
+	assert.False(user[0].GetEnabled())
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+}
+
+func TestReadLDIF(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "users.ldif")
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+		Format:   "ldif",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("euang", user[0].Id)
+	assert.Equal("Euan Garden", user[0].DisplayName)
+	assert.Equal([]string{"user", "sales-engagement-management"}, user[0].Attributes.Roles)
+
+	user, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Chris Johnson [SALES]", user[0].DisplayName)
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+}
+
+func TestReadLDIFTooLongLine(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.ldif")
+	content := "dn: uid=one,dc=com\nuid: one\n\ndn: uid=two,dc=com\ndescription: " + strings.Repeat("x", 17*1024*1024) + "\n"
+	assert.Nil(os.WriteFile(filePath, []byte(content), 0600))
+
+	// the read stops at the line that cannot be scanned instead of retrying it
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath, Format: "ldif"})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), bufio.ErrTooLong.Error())
+	assert.Len(users, 1)
+	assert.Equal("one", users[0].Id)
+}
+
+func TestWriteLDIF(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "test.ldif")
+
+	conf := config.JSONPluginConfig{
+		ToFile:     filePath,
+		Format:     "ldif",
+		LDIFBaseDN: "ou=people,dc=acmecorp,dc=com",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeWrite)
+	assert.Nil(err)
+
+	err = JSONplugin.Write(CreateTestAPIUser("1", "Test Name", "test@email.com"))
+	assert.Nil(err)
+
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	containDN, err := FileContainsString(filePath, "dn: uid=1,ou=people,dc=acmecorp,dc=com")
+	assert.Nil(err)
+	assert.True(containDN)
+
+	containMail, err := FileContainsString(filePath, "mail: test@email.com")
+	assert.Nil(err)
+	assert.True(containMail)
+
+	err = os.Remove(filePath)
+	assert.Nil(err)
+	err = os.RemoveAll(filelock.File(filePath))
+	assert.Nil(err)
+}
+
+func TestReadUsersPath(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "wrapped-users.json")
+	conf := config.JSONPluginConfig{
+		FromFile:  filePath,
+		UsersPath: "/data/users",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Euan Garden", user[0].DisplayName)
+
+	user, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Chris Johnson [SALES]", user[0].DisplayName)
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+
+	// the wrapped file read without a users path
+	err = NewJSONPlugin().Open(&config.JSONPluginConfig{FromFile: filePath}, plugin.OperationTypeRead)
+	assert.NotNil(err)
+	r := regexp.MustCompile("'.*wrapped-users.json': the top-level value is not an array")
+	assert.Regexp(r, err.Error())
+}
+
+func TestWriteTemplate(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "test.json")
+
+	conf := config.JSONPluginConfig{
+		ToFile:        filePath,
+		UsersPath:     "data.users",
+		WriteTemplate: `{"data":{"users":[]},"next":null}`,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeWrite)
+	assert.Nil(err)
+
+	err = JSONplugin.Write(CreateTestAPIUser("1", "Test Name", "test@email.com"))
+	assert.Nil(err)
+
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	content, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(string(content), `{"data":{"users":[`))
+	assert.True(strings.HasSuffix(string(content), "]},\"next\":null}\n"))
+
+	conf = config.JSONPluginConfig{
+		FromFile:  filePath,
+		UsersPath: "data.users",
+	}
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Test Name", user[0].DisplayName)
+
+	err = os.Remove(filePath)
+	assert.Nil(err)
+	err = os.RemoveAll(filelock.File(filePath))
+	assert.Nil(err)
+}
+
+func TestDeleteUsersPath(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	originalFilePath := filepath.Join(filePath, "testing", "wrapped-users.json")
+	copyFilePath := filepath.Join(filePath, "testing", "copy_wrapped-users.json")
+
+	bytesRead, err := os.ReadFile(originalFilePath)
+	assert.Nil(err)
+
+	err = os.WriteFile(copyFilePath, bytesRead, 0600)
+	assert.Nil(err)
+
+	conf := config.JSONPluginConfig{
+		FromFile:  copyFilePath,
+		UsersPath: "data.users",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+
+	err = JSONplugin.Delete("dfdadc39-7335-404d-af66-c77cf13a15f8")
+	assert.Nil(err)
+
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	containDeleted, err := FileContainsString(copyFilePath, "deleted_at")
+	assert.Nil(err)
+	assert.True(containDeleted)
+
+	containNext, err := FileContainsString(copyFilePath, `"next":"eyJvZmZzZXQiOjJ9"`)
+	assert.Nil(err)
+	assert.True(containNext)
+
+	containMeta, err := FileContainsString(copyFilePath, `"source":"acmecorp"`)
+	assert.Nil(err)
+	assert.True(containMeta)
+
+	err = os.Remove(copyFilePath)
+	assert.Nil(err)
+	err = os.RemoveAll(filelock.File(copyFilePath))
+	assert.Nil(err)
+}
+
+func TestReadDirectory(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "departments")
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("April Stewart", user[0].DisplayName)
+
+	user, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Euan Garden", user[0].DisplayName)
+
+	user, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Chris Johnson [SALES]", user[0].DisplayName)
+
+	_, err = JSONplugin.Read()
+	assert.NotNil(err)
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+
+	stats, err := JSONplugin.Close()
+	assert.Nil(err)
+	assert.Equal(int32(3), stats.Received)
+	assert.Equal(int32(1), stats.Errors)
+
+	fileStats := JSONplugin.FileStats()
+	assert.Equal(3, len(fileStats))
+	assert.Equal("engineering.json", filepath.Base(fileStats[0].File))
+	assert.Equal(int32(1), fileStats[0].Received)
+	assert.Equal(int32(2), fileStats[1].Received)
+	assert.Equal("support.json", filepath.Base(fileStats[2].File))
+	assert.Equal(1, len(fileStats[2].Errors))
+}
+
+func TestReadGlob(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	filePath := filepath.Dir(currentDir)
+	filePath = filepath.Join(filePath, "testing", "departments", "[es]*.json")
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	count := 0
+	_, err = JSONplugin.Read()
+	for err != io.EOF {
+		count++
+		_, err = JSONplugin.Read()
+	}
+	assert.Equal(4, count)
+
+	stats, err := JSONplugin.Close()
+	assert.Nil(err)
+	assert.Equal(int32(3), stats.Received)
+}
+
+func writeUsers(conf *config.JSONPluginConfig, users ...*api.User) error {
+	JSONplugin := NewJSONPlugin()
+
+	err := JSONplugin.Open(conf, plugin.OperationTypeWrite)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		err = JSONplugin.Write(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = JSONplugin.Close()
+	return err
+}
+
+func TestWriteShardMaxUsers(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	conf := config.JSONPluginConfig{
+		ToFile:        filepath.Join(dir, "users.json"),
+		ShardMaxUsers: 2,
+	}
+
+	err := writeUsers(&conf,
+		CreateTestAPIUser("1", "One", "one@email.com"),
+		CreateTestAPIUser("2", "Two", "two@email.com"),
+		CreateTestAPIUser("3", "Three", "three@email.com"),
+	)
+	assert.Nil(err)
+
+	assert.False(FileExists(filepath.Join(dir, "users.json")))
+	assert.True(FileExists(filepath.Join(dir, "users-0001.json")))
+	assert.True(FileExists(filepath.Join(dir, "users-0002.json")))
+
+	containThree, err := FileContainsString(filepath.Join(dir, "users-0002.json"), "three@email.com")
+	assert.Nil(err)
+	assert.True(containThree)
+
+	content, err := os.ReadFile(filepath.Join(dir, "users.shards"))
+	assert.Nil(err)
+	m := manifest{}
+	assert.Nil(json.Unmarshal(content, &m))
+	assert.Equal(2, len(m.Shards))
+	assert.Equal("users-0001.json", m.Shards[0].File)
+	assert.Equal(2, m.Shards[0].Users)
+	assert.Equal(1, m.Shards[1].Users)
+}
+
+func TestReadShardedDirectory(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	err := writeUsers(&config.JSONPluginConfig{
+		ToFile:        filepath.Join(dir, "users.json"),
+		ShardMaxUsers: 1,
+	},
+		CreateTestAPIUser("1", "One", "one@email.com"),
+		CreateTestAPIUser("2", "Two", "two@email.com"),
+		CreateTestAPIUser("3", "Three", "three@email.com"),
+	)
+	assert.Nil(err)
+	assert.True(FileExists(filepath.Join(dir, "users.shards")))
+
+	// the manifest next to the shards is not read as a user file
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: dir})
+	assert.Nil(err)
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+	assert.Equal([]string{"1", "2", "3"}, ids)
+
+	// a smaller write removes the shards of the previous one it does not rewrite
+	err = writeUsers(&config.JSONPluginConfig{
+		ToFile:        filepath.Join(dir, "users.json"),
+		ShardMaxUsers: 1,
+	}, CreateTestAPIUser("4", "Four", "four@email.com"))
+	assert.Nil(err)
+	assert.False(FileExists(filepath.Join(dir, "users-0002.json")))
+	assert.False(FileExists(filepath.Join(dir, "users-0003.json")))
+
+	users, err = ReadUsers(&config.JSONPluginConfig{FromFile: dir})
+	assert.Nil(err)
+	assert.Len(users, 1)
+	assert.Equal("4", users[0].Id)
+}
+
+func TestWriteShardMaxBytes(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	conf := config.JSONPluginConfig{
+		ToFile:        filepath.Join(dir, "users.json"),
+		ShardMaxBytes: 400,
+	}
+
+	err := writeUsers(&conf,
+		CreateTestAPIUser("1", "One", "one@email.com"),
+		CreateTestAPIUser("2", "Two", "two@email.com"),
+		CreateTestAPIUser("3", "Three", "three@email.com"),
+	)
+	assert.Nil(err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "users-*.json"))
+	assert.Nil(err)
+	assert.True(len(files) > 1)
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		assert.Nil(err)
+		assert.LessOrEqual(info.Size(), int64(400))
+	}
+}
+
+func TestWriteShardBy(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	conf := config.JSONPluginConfig{
+		ToFile:  filepath.Join(dir, "users.json"),
+		ShardBy: "attributes.properties.department",
+	}
+
+	sales := CreateTestAPIUser("1", "One", "one@email.com")
+	sales.Attributes.Properties.Fields["department"] = structpb.NewStringValue("Sales Engagement")
+	engineering := CreateTestAPIUser("2", "Two", "two@email.com")
+	engineering.Attributes.Properties.Fields["department"] = structpb.NewStringValue("Engineering")
+
+	err := writeUsers(&conf, sales, engineering, CreateTestAPIUser("3", "Three", "three@email.com"))
+	assert.Nil(err)
+
+	assert.True(FileExists(filepath.Join(dir, "users-Sales_Engagement.json")))
+	assert.True(FileExists(filepath.Join(dir, "users-Engineering.json")))
+	assert.True(FileExists(filepath.Join(dir, "users-none.json")))
+
+	content, err := os.ReadFile(filepath.Join(dir, "users.shards"))
+	assert.Nil(err)
+	m := manifest{}
+	assert.Nil(json.Unmarshal(content, &m))
+	assert.Equal(3, len(m.Shards))
+	assert.Equal("", m.Shards[0].Key)
+	assert.Equal("Engineering", m.Shards[1].Key)
+	assert.Equal("Sales Engagement", m.Shards[2].Key)
+}
+
+func TestWriteShardByCollidingNames(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	conf := config.JSONPluginConfig{
+		ToFile:  filepath.Join(dir, "users.json"),
+		ShardBy: "attributes.properties.department",
+	}
+
+	users := []*api.User{}
+	for i, department := range []string{"R&D", "R D", "none", ""} {
+		user := CreateTestAPIUser(fmt.Sprint(i+1), department, fmt.Sprintf("%d@email.com", i+1))
+		if department != "" {
+			user.Attributes.Properties.Fields["department"] = structpb.NewStringValue(department)
+		}
+		users = append(users, user)
+	}
+	assert.Nil(writeUsers(&conf, users...))
+
+	content, err := os.ReadFile(filepath.Join(dir, "users.shards"))
+	assert.Nil(err)
+	m := manifest{}
+	assert.Nil(json.Unmarshal(content, &m))
+	files := map[string]string{}
+	for _, sh := range m.Shards {
+		assert.Equal(1, sh.Users)
+		files[sh.Key] = sh.File
+	}
+	assert.Equal(map[string]string{
+		"R&D":  "users-R_D.json",
+		"R D":  "users-R_D-2.json",
+		"none": "users-none.json",
+		"":     "users-none-2.json",
+	}, files)
+
+	for key, file := range files {
+		read, err := ReadUsers(&config.JSONPluginConfig{FromFile: filepath.Join(dir, file)})
+		assert.Nil(err)
+		assert.Len(read, 1)
+		assert.Equal(key, read[0].DisplayName)
+	}
+}
+
+func TestShardKeyIdentityProvider(t *testing.T) {
+	assert := require.New(t)
+
+	JSONplugin := NewJSONPlugin()
+	JSONplugin.shardBy = []string{"identities", "*", "provider"}
+
+	user := CreateTestAPIUser("1", "One", "one@email.com")
+	user.Identities["one"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_USERNAME}
+	user.Identities["one@email.com"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_EMAIL, Provider: "auth0"}
+
+	key, err := JSONplugin.shardKey(user)
+	assert.Nil(err)
+	assert.Equal("auth0", key)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(err)
+
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "key.txt")
+	err = os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	assert.Nil(err)
+
+	filePath := filepath.Join(dir, "users.json.age")
+	conf := config.JSONPluginConfig{
+		ToFile:       filePath,
+		IdentityFile: identityFile,
+	}
+	err = writeUsers(&conf, CreateTestAPIUser("1", "Test Name", "test@email.com"))
+	assert.Nil(err)
+
+	containName, err := FileContainsString(filePath, "Test Name")
+	assert.Nil(err)
+	assert.False(containName)
+
+	conf = config.JSONPluginConfig{
+		FromFile:     filePath,
+		IdentityFile: identityFile,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	err = JSONplugin.Delete("1")
+	assert.Nil(err)
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Test Name", user[0].DisplayName)
+	assert.True(user[0].Deleted)
+}
+
+func TestReadEncryptedWithWrongKey(t *testing.T) {
+	assert := require.New(t)
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(err)
+	other, err := age.GenerateX25519Identity()
+	assert.Nil(err)
+
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "key.txt")
+	err = os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	assert.Nil(err)
+	otherFile := filepath.Join(dir, "other.txt")
+	err = os.WriteFile(otherFile, []byte(other.String()+"\n"), 0600)
+	assert.Nil(err)
+
+	filePath := filepath.Join(dir, "users.json.age")
+	conf := config.JSONPluginConfig{
+		ToFile:       filePath,
+		IdentityFile: identityFile,
+	}
+	err = writeUsers(&conf, CreateTestAPIUser("1", "Test Name", "test@email.com"))
+	assert.Nil(err)
+
+	conf = config.JSONPluginConfig{
+		FromFile:     filePath,
+		IdentityFile: otherFile,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.NotNil(err)
+	r := regexp.MustCompile("users.json.age': cannot decrypt, wrong key or corrupted file")
+	assert.Regexp(r, err.Error())
+
+	conf = config.JSONPluginConfig{
+		FromFile: filePath,
+	}
+	err = conf.Validate(plugin.OperationTypeRead)
+	assert.NotNil(err)
+	r = regexp.MustCompile("InvalidArgument desc = '.*users.json.age' is encrypted but no decryption key is configured")
+	assert.Regexp(r, err.Error())
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.Nil(err)
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	assert.Nil(err)
+
+	signingKeyFile := filepath.Join(dir, "signing.pem")
+	err = os.WriteFile(signingKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600)
+	assert.Nil(err)
+	verifyKeyFile := filepath.Join(dir, "verify.pem")
+	err = os.WriteFile(verifyKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600)
+	assert.Nil(err)
+
+	filePath := filepath.Join(dir, "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:         filePath,
+		SigningKeyFile: signingKeyFile,
+	}
+	err = writeUsers(&conf, CreateTestAPIUser("1", "Test Name", "test@email.com"))
+	assert.Nil(err)
+	assert.True(FileExists(filePath + ".sha256"))
+	assert.True(FileExists(filePath + ".sig"))
+
+	conf = config.JSONPluginConfig{
+		FromFile:      filePath,
+		VerifyKeyFile: verifyKeyFile,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	user, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Test Name", user[0].DisplayName)
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	content, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	err = os.WriteFile(filePath, []byte(strings.Replace(string(content), "Test Name", "Evil Name", 1)), 0600)
+	assert.Nil(err)
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.NotNil(err)
+	r := regexp.MustCompile("PermissionDenied desc = '.*users.json' failed signature verification: checksum mismatch")
+	assert.Regexp(r, err.Error())
+}
+
+func TestWriteRedacted(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_REDACT_KEY", "secret")
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:       filePath,
+		Redact:       "email=hash,display_name=mask",
+		RedactKeyEnv: "TEST_JSON_REDACT_KEY",
+	}
+
+	user := CreateTestAPIUser("1", "Test Name", "test@email.com")
+	err := writeUsers(&conf, user)
+	assert.Nil(err)
+	assert.Equal("test@email.com", user.Email, "the written user should not be modified")
+
+	containEmail, err := FileContainsString(filePath, "test@email.com")
+	assert.Nil(err)
+	assert.False(containEmail)
+
+	containName, err := FileContainsString(filePath, "T********")
+	assert.Nil(err)
+	assert.True(containName)
+}
+
+func TestReadNormalized(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	conf := config.JSONPluginConfig{
+		FromFile:  filepath.Join(filepath.Dir(currentDir), "testing", "invalid-user.json"),
+		Normalize: "all",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	users, err := JSONplugin.Read()
+	assert.Nil(err, "the empty identity kind should be inferred")
+	assert.Equal("Euan Garden", users[0].DisplayName)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, users[0].Identities["+18045553383"].Kind)
+
+	users, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("Chris Johnson [SALES]", users[0].DisplayName)
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+}
+
+func TestWriteNormalized(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:    filePath,
+		Normalize: "email,phone",
+	}
+
+	err := writeUsers(&conf, CreateTestAPIUser("1", "Test Name", "Test@Email.com"))
+	assert.Nil(err)
+
+	containEmail, err := FileContainsString(filePath, "\"test@email.com\"")
+	assert.Nil(err)
+	assert.True(containEmail)
+
+	containUpper, err := FileContainsString(filePath, "Test@Email.com")
+	assert.Nil(err)
+	assert.False(containUpper)
+}
+
+func TestReadDerivedIDs(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(filePath, []byte(`[
+		{"display_name": "One", "email": "one@email.com"},
+		{"id": "2", "display_name": "Two", "email": "two@email.com"},
+		{"display_name": "Three"}
+	]`), 0600)
+	assert.Nil(err)
+
+	conf := config.JSONPluginConfig{
+		FromFile:   filePath,
+		IDStrategy: "uuid5",
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	users, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Len(users[0].Id, 36)
+
+	users, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("2", users[0].Id)
+
+	_, err = JSONplugin.Read()
+	assert.NotNil(err)
+	assert.Equal("user 'Three' has no email identity to derive an id from", err.Error())
+
+	_, err = JSONplugin.Read()
+	assert.Equal(io.EOF, err)
+
+	stats := JSONplugin.FileStats()
+	assert.Equal(int32(1), stats[0].DerivedIDs)
+	assert.Equal(1, len(stats[0].Errors))
+
+	generated, derived := JSONplugin.AssignedIDs()
+	assert.Equal(int32(0), generated)
+	assert.Equal(int32(1), derived)
+}
+
+func TestWriteRoleMapping(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	mapFile := filepath.Join(dir, "roles.json")
+	err := os.WriteFile(mapFile, []byte(`{"roles": {"user": "member"}, "permissions": {"member": ["profile.read"]}}`), 0600)
+	assert.Nil(err)
+
+	filePath := filepath.Join(dir, "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:      filePath,
+		RoleMapFile: mapFile,
+	}
+
+	user := CreateTestAPIUser("1", "Test Name", "test@email.com")
+	user.Attributes.Roles = []string{"user"}
+	err = writeUsers(&conf, user)
+	assert.Nil(err)
+	assert.Equal([]string{"user"}, user.Attributes.Roles, "the written user should not be modified")
+
+	conf = config.JSONPluginConfig{
+		FromFile: filePath,
+	}
+	JSONplugin := NewJSONPlugin()
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	users, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal([]string{"member"}, users[0].Attributes.Roles)
+	assert.Equal([]string{"profile.read"}, users[0].Attributes.Permissions)
+}
+
+func TestDeleteTimestamps(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:         filePath,
+		FromFile:       filePath,
+		FillTimestamps: true,
+	}
+
+	user := CreateTestAPIUser("1", "Test Name", "test@email.com")
+	user.Metadata = nil
+
+	JSONplugin := NewJSONPlugin()
+	JSONplugin.Now = func() time.Time { return now.Add(-time.Hour) }
+	err := JSONplugin.Open(&conf, plugin.OperationTypeWrite)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Write(user))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	JSONplugin = NewJSONPlugin()
+	JSONplugin.Now = func() time.Time { return now }
+	err = JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Delete("1"))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	JSONplugin = NewJSONPlugin()
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	users, err := JSONplugin.Read()
+	assert.Nil(err)
+
+	metadata := users[0].Metadata
+	assert.Equal("2022-03-04T03:06:07Z", metadata.CreatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T04:06:07Z", metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T04:06:07Z", metadata.DeletedAt.AsTime().Format(time.RFC3339))
+}
+
+func TestWriteReplacedTimestamps(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:         filePath,
+		FromFile:       filePath,
+		FillTimestamps: true,
+	}
+	write := func(at time.Time, users ...*api.User) {
+		JSONplugin := NewJSONPlugin()
+		JSONplugin.Now = func() time.Time { return at }
+		assert.Nil(JSONplugin.Open(&conf, plugin.OperationTypeWrite))
+		for _, user := range users {
+			assert.Nil(JSONplugin.Write(user))
+		}
+		_, err := JSONplugin.Close()
+		assert.Nil(err)
+	}
+	newUser := func(id, email string) *api.User {
+		user := CreateTestAPIUser(id, "Name "+id, email)
+		user.Metadata = nil
+		return user
+	}
+
+	write(now, newUser("1", "one@email.com"), newUser("2", "two@email.com"))
+	// the first user changes, the second is written again as it was
+	write(now.Add(time.Hour), newUser("1", "first@email.com"), newUser("2", "two@email.com"), newUser("3", "three@email.com"))
+
+	users, err := ReadUsers(&conf)
+	assert.Nil(err)
+	assert.Equal(3, len(users))
+	// the replaced users keep their creation time
+	assert.Equal("2022-03-04T05:06:07Z", users[0].Metadata.CreatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T06:06:07Z", users[0].Metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T05:06:07Z", users[1].Metadata.CreatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T05:06:07Z", users[1].Metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T06:06:07Z", users[2].Metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal(users[2].Metadata.CreatedAt.AsTime(), users[2].Metadata.UpdatedAt.AsTime(), "a new user is created and updated at once")
+}
+
+func TestDeletePreservesUnknownFields(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(filePath, []byte(`[
+		{"id": "1", "display_name": "One", "x_source": "hr", "attributes": {"x_cost_center": "1234"}},
+		{"id": "2", "display_name": "Two"}
+	]`), 0600)
+	assert.Nil(err)
+
+	conf := config.JSONPluginConfig{
+		FromFile:        filePath,
+		PreserveUnknown: true,
+	}
+	JSONplugin := NewJSONPlugin()
+
+	err = JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Delete("2"))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	content, err := os.ReadFile(filePath)
+	assert.Nil(err)
+
+	var users []map[string]interface{}
+	assert.Nil(json.Unmarshal(content, &users))
+	assert.Equal("hr", users[0]["x_source"])
+	assert.Equal("1234", users[0]["attributes"].(map[string]interface{})["x_cost_center"])
+	assert.Equal(true, users[1]["deleted"])
+}
+
+func TestReadUnknownFields(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(filePath, []byte(`[{"id": "1", "x_source": "hr"}]`), 0600)
+	assert.Nil(err)
+
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+	}
+	JSONplugin := NewJSONPlugin()
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	_, err = JSONplugin.Read()
+	assert.NotNil(err, "unknown fields should be rejected unless preserved")
+
+	conf.PreserveUnknown = true
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	users, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("1", users[0].Id)
+}
+
+func TestWriteCanonical(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	first := CreateTestAPIUser("1", "Test Name", "test@email.com")
+	first.Attributes.Roles = []string{"user", "admin"}
+	first.Identities["test@email.com"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_EMAIL}
+	first.Identities["test"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_USERNAME}
+	second := proto.Clone(first).(*api.User)
+	second.Attributes.Roles = []string{"admin", "user"}
+
+	for i, user := range []*api.User{first, second} {
+		conf := config.JSONPluginConfig{
+			ToFile:      filepath.Join(dir, fmt.Sprintf("users-%d.json", i)),
+			OutputStyle: config.StyleCanonical,
+		}
+		assert.Nil(writeUsers(&conf, user))
+	}
+
+	a, err := os.ReadFile(filepath.Join(dir, "users-0.json"))
+	assert.Nil(err)
+	b, err := os.ReadFile(filepath.Join(dir, "users-1.json"))
+	assert.Nil(err)
+	assert.Equal(a, b)
+	assert.Contains(string(a), `"roles":["admin","user"]`)
+	assert.Contains(string(a), `"display_name":"Test Name","email":"test@email.com","id":"1","identities":{"test":`)
+}
+
+func TestWriteCompactWithOptions(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:          filePath,
+		OutputStyle:     config.StyleCompact,
+		EmitUnpopulated: true,
+		EnumNumbers:     true,
+	}
+
+	user := CreateTestAPIUser("1", "Test Name", "test@email.com")
+	user.Identities["test@email.com"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_EMAIL}
+	assert.Nil(writeUsers(&conf, user))
+
+	content, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	lines := strings.Split(string(content), "\n")
+	assert.Equal(4, len(lines), "every record should be on a single line")
+	assert.Contains(lines[1], `"kind":2`)
+	assert.Contains(lines[1], `"picture":""`)
+}
+
+func TestWriteSortBy(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_SORT_PASSPHRASE", "secret")
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	conf := config.JSONPluginConfig{
+		ToFile:        filePath,
+		SortBy:        config.SortByEmail,
+		SortBuffer:    2,
+		PassphraseEnv: "TEST_JSON_SORT_PASSPHRASE",
+	}
+
+	emails := []string{"eve@email.com", "bob@email.com", "dan@email.com", "amy@email.com", "cat@email.com"}
+	users := []*api.User{}
+	for i, email := range emails {
+		users = append(users, CreateTestAPIUser(fmt.Sprint(i), email, email))
+	}
+	assert.Nil(writeUsers(&conf, users...))
+
+	conf = config.JSONPluginConfig{
+		FromFile:      filePath,
+		PassphraseEnv: "TEST_JSON_SORT_PASSPHRASE",
+	}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	read := []string{}
+	for {
+		users, err := JSONplugin.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(err)
+		read = append(read, users[0].Email)
+	}
+	assert.Equal([]string{"amy@email.com", "bob@email.com", "cat@email.com", "dan@email.com", "eve@email.com"}, read)
+}
+
+func TestWriteStreamsUsers(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&config.JSONPluginConfig{ToFile: filePath}, plugin.OperationTypeWrite)
+	assert.Nil(err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(JSONplugin.Write(CreateTestAPIUser(fmt.Sprint(i), "Name", fmt.Sprintf("user%d@email.com", i))))
+	}
+
+	// the users are on disk aside the file before it is closed
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.Nil(err)
+	assert.Len(tmps, 1)
+	info, err := os.Stat(tmps[0])
+	assert.Nil(err)
+	assert.NotZero(info.Size())
+	_, err = os.Stat(filePath)
+	assert.True(os.IsNotExist(err))
+
+	stats, err := JSONplugin.Close()
+	assert.Nil(err)
+	assert.Nil(stats)
+
+	tmps, err = filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.Nil(err)
+	assert.Empty(tmps)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	assert.Equal(100, len(users))
+}
+
+func TestSorterSpills(t *testing.T) {
+	assert := require.New(t)
+
+	s, err := newSorter(config.SortByID, 3, false)
+	assert.Nil(err)
+
+	for _, id := range []string{"5", "3", "9", "1", "7", "2", "8"} {
+		assert.Nil(s.add(CreateTestAPIUser(id, "Name", id+"@email.com")))
+	}
+	assert.Equal(2, len(s.spills))
+	dir := s.dir
+
+	ids := []string{}
+	err = s.each(func(user *api.User) error {
+		ids = append(ids, user.Id)
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"1", "2", "3", "5", "7", "8", "9"}, ids)
+
+	s.cleanup()
+	_, err = os.Stat(dir)
+	assert.True(os.IsNotExist(err), "the spill files should be removed")
+}
+
+func TestSorterMergesInPasses(t *testing.T) {
+	assert := require.New(t)
+
+	s, err := newSorter(config.SortByEmail, 2, true)
+	assert.Nil(err)
+	s.fanIn = 2
+
+	ids := []string{"9", "4", "7", "1", "8", "3", "6", "2", "5", "0"}
+	for _, id := range ids {
+		assert.Nil(s.add(CreateTestAPIUser(id, "Name", id+"@email.com")))
+	}
+	assert.Equal(5, len(s.spills))
+	defer s.cleanup()
+
+	sorted := []string{}
+	err = s.each(func(user *api.User) error {
+		sorted = append(sorted, user.Id)
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, sorted)
+	assert.Equal(2, len(s.spills), "the spills should be merged down to the fan-in")
+
+	files, err := os.ReadDir(s.dir)
+	assert.Nil(err)
+	assert.Len(files, 2, "the merged spills should be removed")
+}
+
+func TestReadUsers(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{
+		FromFile: filepath.Join(filepath.Dir(currentDir), "testing", "invalid-user.json"),
+	})
+	assert.NotNil(err, "the invalid record should be reported")
+	assert.Equal(1, len(users))
+	assert.Equal("Chris Johnson [SALES]", users[0].DisplayName)
+}
+
+func TestApplyChanges(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	err := writeUsers(&config.JSONPluginConfig{ToFile: filePath},
+		CreateTestAPIUser("1", "One", "one@email.com"),
+		CreateTestAPIUser("2", "Two", "two@email.com"),
+		CreateTestAPIUser("3", "Three", "three@email.com"),
+	)
+	assert.Nil(err)
+
+	changes := []*diff.Change{
+		{ID: "1", Change: diff.Modified, Patch: []*diff.Operation{{Op: diff.OpReplace, Path: "/email", Value: "first@email.com"}}},
+		{ID: "2", Change: diff.Removed},
+		{ID: "3", Change: diff.Deleted},
+		{ID: "4", Change: diff.Added, User: map[string]interface{}{"display_name": "Four"}},
+		{ID: "5", Change: diff.Modified},
+	}
+
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	JSONplugin := NewJSONPlugin()
+	JSONplugin.Now = func() time.Time { return now }
+	conf := config.JSONPluginConfig{
+		FromFile: filePath,
+		ToFile:   filepath.Join(dir, "changed.json"),
+	}
+	results, err := JSONplugin.Apply(&conf, changes)
+	assert.Nil(err)
+
+	statuses := []string{}
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	assert.Equal([]string{ChangeApplied, ChangeApplied, ChangeApplied, ChangeApplied, ChangeNotFound}, statuses)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: conf.ToFile})
+	assert.Nil(err)
+	assert.Equal(3, len(users))
+	assert.Equal("first@email.com", users[0].Email)
+	assert.Equal("3", users[1].Id)
+	assert.True(users[1].Deleted)
+	assert.Equal(now.Unix(), users[1].Metadata.DeletedAt.Seconds)
+	assert.Equal("Four", users[2].DisplayName)
+	assert.Equal("4", users[2].Id)
+
+	results, err = Apply(&config.JSONPluginConfig{FromFile: conf.ToFile, ToFile: conf.ToFile}, []*diff.Change{
+		{ID: "1", Change: diff.Added, User: map[string]interface{}{"display_name": "Other"}},
+	})
+	assert.Nil(err)
+	assert.Equal(ChangeExists, results[0].Status)
+
+	_, err = Apply(&conf, []*diff.Change{{ID: "1", Change: diff.Removed}, {ID: "1", Change: diff.Deleted}})
+	assert.NotNil(err)
+	assert.Equal("user '1' is changed more than once", err.Error())
+}
+
+func TestApplyRoleMapping(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	mapFile := filepath.Join(dir, "roles.json")
+	err := os.WriteFile(mapFile, []byte(`{"roles": {"sales": "seller"}}`), 0600)
+	assert.Nil(err)
+
+	for _, unmapped := range []string{"drop", "fail"} {
+		filePath := filepath.Join(dir, unmapped+".json")
+		user := CreateTestAPIUser("1", "One", "one@email.com")
+		user.Attributes.Roles = []string{"sales"}
+		err = writeUsers(&config.JSONPluginConfig{ToFile: filePath}, user, CreateTestAPIUser("2", "Two", "two@email.com"))
+		assert.Nil(err)
+
+		conf := config.JSONPluginConfig{
+			FromFile:      filePath,
+			ToFile:        filePath,
+			RoleMapFile:   mapFile,
+			UnmappedRoles: unmapped,
+		}
+		results, err := Apply(&conf, []*diff.Change{
+			{ID: "2", Change: diff.Modified, Patch: []*diff.Operation{{Op: diff.OpReplace, Path: "/email", Value: "second@email.com"}}},
+			{ID: "3", Change: diff.Added, User: map[string]interface{}{"attributes": map[string]interface{}{"roles": []interface{}{"sales"}}}},
+		})
+		assert.Nil(err, unmapped)
+		assert.Equal(ChangeApplied, results[0].Status)
+		assert.Equal(ChangeApplied, results[1].Status)
+
+		// the roles are mapped once, the mapped roles are not mapped again
+		users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+		assert.Nil(err)
+		assert.Equal(3, len(users))
+		assert.Equal([]string{"seller"}, users[0].Attributes.Roles, unmapped)
+		assert.Equal("second@email.com", users[1].Email)
+		assert.Equal([]string{"seller"}, users[2].Attributes.Roles, unmapped)
+	}
+}
+
+func TestApplyFailureReleasesFile(t *testing.T) {
+	assert := require.New(t)
+
+	currentDir, err := os.Getwd()
+	assert.Nil(err)
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(currentDir), "testing", "invalid-user.json"))
+	assert.Nil(err)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	assert.Nil(os.WriteFile(filePath, content, 0600))
+
+	conf := config.JSONPluginConfig{FromFile: filePath, ToFile: filePath}
+	for i := 0; i < 2; i++ {
+		_, err = Apply(&conf, nil)
+		assert.NotNil(err)
+		assert.NotContains(err.Error(), "locked", "the failed apply should release its lock")
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.Nil(err)
+	assert.Empty(tmps)
+	after, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	assert.Equal(content, after)
+}
+
+func TestApplyLocksBeforeReading(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, CreateTestAPIUser("1", "One", "one@email.com")))
+
+	lock, err := filelock.Acquire(filePath, 0)
+	assert.Nil(err)
+	defer lock.Release() // nolint:errcheck // the test directory is removed
+
+	// a missing from-file fails the read, the lock is expected to fail first
+	assert.Nil(os.Remove(filePath))
+	_, err = Apply(&config.JSONPluginConfig{FromFile: filePath, ToFile: filePath}, nil)
+	assert.NotNil(err)
+	assert.Equal(codes.Unavailable, status.Code(err))
+}
+
+func TestApplyRewritesEveryUser(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	watermark := filepath.Join(dir, "watermark")
+	err := writeUsers(&config.JSONPluginConfig{ToFile: filePath},
+		CreateTestAPIUser("1", "One", "one@email.com"),
+		CreateTestAPIUser("2", "Two", "two@email.com"),
+	)
+	assert.Nil(err)
+
+	_, err = Apply(&config.JSONPluginConfig{
+		FromFile:      filePath,
+		ToFile:        filePath,
+		Since:         "2100-01-01T00:00:00Z",
+		WatermarkFile: watermark,
+	}, nil)
+	assert.Nil(err)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	assert.Equal(2, len(users), "users older than since should not be dropped")
+	_, err = os.Stat(watermark)
+	assert.True(os.IsNotExist(err), "apply should not save the watermark")
+}
+
+func TestReadIncremental(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	watermark := filepath.Join(dir, "watermark")
+
+	stamp := func(user *api.User, updated string) *api.User {
+		ts, err := time.Parse(time.RFC3339, updated)
+		assert.Nil(err)
+		user.Metadata = &api.Metadata{CreatedAt: timestamppb.New(ts), UpdatedAt: timestamppb.New(ts)}
+		return user
+	}
+	write := func(users ...*api.User) {
+		assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, users...))
+	}
+	read := func() []string {
+		JSONplugin := NewJSONPlugin()
+		err := JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath, WatermarkFile: watermark}, plugin.OperationTypeRead)
+		assert.Nil(err)
+		ids := []string{}
+		for {
+			users, err := JSONplugin.Read()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(err)
+			ids = append(ids, users[0].Id)
+		}
+		_, err = JSONplugin.Close()
+		assert.Nil(err)
+		return ids
+	}
+
+	one := stamp(CreateTestAPIUser("1", "One", "one@email.com"), "2022-01-01T00:00:00Z")
+	two := stamp(CreateTestAPIUser("2", "Two", "two@email.com"), "2022-01-02T00:00:00Z")
+	write(one, two)
+	assert.Equal([]string{"1", "2"}, read())
+
+	content, err := os.ReadFile(watermark)
+	assert.Nil(err)
+	assert.Equal("2022-01-02T00:00:00Z\n", string(content))
+
+	assert.Equal([]string{}, read(), "unchanged users should not be read again")
+
+	one = stamp(one, "2022-01-03T00:00:00Z")
+	one.Deleted = true
+	three := stamp(CreateTestAPIUser("3", "Three", "three@email.com"), "2022-01-01T12:00:00Z")
+	write(one, two, three)
+	assert.Equal([]string{"1"}, read())
+
+	JSONplugin := NewJSONPlugin()
+	err = JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath, Since: "2022-01-01T06:00:00Z"}, plugin.OperationTypeRead)
+	assert.Nil(err)
+	count := 0
+	for _, err = JSONplugin.Read(); err == nil; _, err = JSONplugin.Read() {
+		count++
+	}
+	stats, err := JSONplugin.Close()
+	assert.Nil(err)
+	assert.Equal(3, count)
+	assert.Equal(int32(3), stats.Received)
+}
+
+func TestReadInterruptedKeepsWatermark(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	watermark := filepath.Join(dir, "watermark")
+
+	newer := CreateTestAPIUser("new", "New", "new@email.com")
+	newer.Metadata.UpdatedAt = timestamppb.New(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	older := CreateTestAPIUser("old", "Old", "old@email.com")
+	older.Metadata.CreatedAt = timestamppb.New(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	older.Metadata.UpdatedAt = older.Metadata.CreatedAt
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, newer, older))
+
+	conf := config.JSONPluginConfig{FromFile: filePath, WatermarkFile: watermark}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	users, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("new", users[0].Id)
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+	assert.False(FileExists(watermark), "an interrupted read should not move the watermark")
+
+	users, err = ReadUsers(&conf)
+	assert.Nil(err)
+	assert.Len(users, 2)
+}
+
+func TestReadResumesFromCheckpoint(t *testing.T) {
+	assert := require.New(t)
+
+	t.Setenv("TEST_JSON_CHECKPOINT_PASSPHRASE", "secret")
+
+	for _, passphraseEnv := range []string{"", "TEST_JSON_CHECKPOINT_PASSPHRASE"} {
+		dir := t.TempDir()
+		filePath := filepath.Join(dir, "users.json")
+		checkpointFile := filepath.Join(dir, "checkpoint.json")
+
+		users := []*api.User{}
+		for i := 1; i <= 5; i++ {
+			users = append(users, CreateTestAPIUser(fmt.Sprint(i), "Name", fmt.Sprintf("%d@email.com", i)))
+		}
+		err := writeUsers(&config.JSONPluginConfig{
+			ToFile:        filePath,
+			UsersPath:     "users",
+			PassphraseEnv: passphraseEnv,
+		}, users...)
+		assert.Nil(err)
+
+		conf := config.JSONPluginConfig{
+			FromFile:        filePath,
+			UsersPath:       "users",
+			PassphraseEnv:   passphraseEnv,
+			CheckpointFile:  checkpointFile,
+			CheckpointEvery: 2,
+		}
+
+		JSONplugin := NewJSONPlugin()
+		err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+		assert.Nil(err)
+		for i := 0; i < 3; i++ {
+			_, err = JSONplugin.Read()
+			assert.Nil(err)
+		}
+		_, err = JSONplugin.Close()
+		assert.Nil(err)
+		assert.True(FileExists(checkpointFile), "an interrupted read should leave a checkpoint")
+
+		JSONplugin = NewJSONPlugin()
+		err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+		assert.Nil(err)
+		ids := []string{}
+		for {
+			users, err := JSONplugin.Read()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(err)
+			ids = append(ids, users[0].Id)
+		}
+		_, err = JSONplugin.Close()
+		assert.Nil(err)
+
+		// the third user was returned, but not known to be handled before the close
+		assert.Equal([]string{"3", "4", "5"}, ids)
+		assert.False(FileExists(checkpointFile), "a completed read should remove the checkpoint")
+	}
+}
+
+func TestReadResumesAtFailedRecord(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	content := []byte(`[
+{"id": "1", "email": "one@email.com"},
+{"email": "two@email.com"},
+{"id": "3", "email": "three@email.com"},
+{"id": "4", "email": "four@email.com"}
+]
+`)
+	assert.Nil(os.WriteFile(filePath, content, 0600))
+
+	conf := config.JSONPluginConfig{
+		FromFile:        filePath,
+		CheckpointFile:  checkpointFile,
+		CheckpointEvery: 1,
+		IDStrategy:      "fail",
+	}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	users, err := JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("1", users[0].Id)
+	_, err = JSONplugin.Read()
+	assert.NotNil(err)
+	users, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("3", users[0].Id)
+	users, err = JSONplugin.Read()
+	assert.Nil(err)
+	assert.Equal("4", users[0].Id)
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	// the checkpoint does not move past the record that failed
+	cp := &checkpoint{}
+	b, err := os.ReadFile(checkpointFile)
+	assert.Nil(err)
+	assert.Nil(json.Unmarshal(b, cp))
+	assert.Equal(int64(1), cp.Record)
+
+	conf.IDStrategy = "keep"
+	JSONplugin = NewJSONPlugin()
+	err = JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	emails := []string{}
+	for {
+		users, err := JSONplugin.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(err)
+		emails = append(emails, users[0].Email)
+	}
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+	assert.Equal([]string{"two@email.com", "three@email.com", "four@email.com"}, emails)
+}
+
+func TestReadCheckpointOfChangedFile(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	write := func(users ...*api.User) {
+		assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, users...))
+	}
+	write(CreateTestAPIUser("1", "One", "one@email.com"), CreateTestAPIUser("2", "Two", "two@email.com"))
+
+	conf := config.JSONPluginConfig{
+		FromFile:       filePath,
+		CheckpointFile: checkpointFile,
+	}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeRead)
+	assert.Nil(err)
+	for i := 0; i < 2; i++ {
+		_, err = JSONplugin.Read()
+		assert.Nil(err)
+	}
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	write(CreateTestAPIUser("3", "Three", "three@email.com"))
+
+	err = NewJSONPlugin().Open(&conf, plugin.OperationTypeRead)
+	assert.NotNil(err)
+	r := regexp.MustCompile("'.*users.json' changed after checkpoint '.*checkpoint.json' was written")
+	assert.Regexp(r, err.Error())
+}
+
+func TestGetUserFromWrittenIndex(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+
+	users := []*api.User{}
+	for i := 1; i <= 3; i++ {
+		user := CreateTestAPIUser(fmt.Sprint(i), fmt.Sprintf("Name %d", i), fmt.Sprintf("%d@email.com", i))
+		user.Identities[user.Email] = &api.IdentitySource{
+			Kind:     api.IdentityKind_IDENTITY_KIND_EMAIL,
+			Provider: "local",
+			Verified: true,
+		}
+		users = append(users, user)
+	}
+	err := writeUsers(&config.JSONPluginConfig{
+		ToFile:     filePath,
+		UsersPath:  "users",
+		WriteIndex: true,
+	}, users...)
+	assert.Nil(err)
+	assert.True(FileExists(filePath + ".idx"))
+
+	JSONplugin := NewJSONPlugin()
+	err = JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath, UsersPath: "users"}, plugin.OperationTypeRead)
+	assert.Nil(err)
+
+	user, err := JSONplugin.GetUser("2")
+	assert.Nil(err)
+	assert.Equal("Name 2", user.DisplayName)
+
+	user, err = JSONplugin.GetUser("3@email.com")
+	assert.Nil(err)
+	assert.Equal("3", user.Id)
+
+	_, err = JSONplugin.GetUser("4")
+	assert.NotNil(err)
+	assert.Equal(codes.NotFound, status.Code(err))
+
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+}
+
+func TestGetUserVerifiesSignature(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.Nil(err)
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	assert.Nil(err)
+
+	signingKeyFile := filepath.Join(dir, "signing.pem")
+	err = os.WriteFile(signingKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600)
+	assert.Nil(err)
+	verifyKeyFile := filepath.Join(dir, "verify.pem")
+	err = os.WriteFile(verifyKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600)
+	assert.Nil(err)
+
+	filePath := filepath.Join(dir, "users.json")
+	err = writeUsers(&config.JSONPluginConfig{
+		ToFile:         filePath,
+		SigningKeyFile: signingKeyFile,
+		WriteIndex:     true,
+	}, CreateTestAPIUser("1", "Test Name", "test@email.com"))
+	assert.Nil(err)
+	assert.True(FileExists(filePath + ".idx.sig"))
+
+	JSONplugin := NewJSONPlugin()
+	err = JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath, VerifyKeyFile: verifyKeyFile}, plugin.OperationTypeRead)
+	assert.Nil(err)
+	defer JSONplugin.Close() // nolint:errcheck // read stats are not used
+
+	user, err := JSONplugin.GetUser("1")
+	assert.Nil(err)
+	assert.Equal("Test Name", user.DisplayName)
+
+	// later lookups read the handle verified by the first one
+	assert.Nil(os.Rename(filePath+".sig", filePath+".sig.bak"))
+	user, err = JSONplugin.GetUser("1")
+	assert.Nil(err)
+	assert.Equal("Test Name", user.DisplayName)
+	assert.Nil(os.Rename(filePath+".sig.bak", filePath+".sig"))
+
+	// the size and modification time the index checks are kept
+	info, err := os.Stat(filePath)
+	assert.Nil(err)
+	content, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	err = os.WriteFile(filePath, []byte(strings.Replace(string(content), "Test Name", "Evil Name", 1)), 0600)
+	assert.Nil(err)
+	assert.Nil(os.Chtimes(filePath, info.ModTime(), info.ModTime()))
+
+	// the file is verified once per open, the next open checks the new content
+	err = NewJSONPlugin().Open(&config.JSONPluginConfig{FromFile: filePath, VerifyKeyFile: verifyKeyFile}, plugin.OperationTypeRead)
+	assert.NotNil(err)
+	assert.Equal(codes.PermissionDenied, status.Code(err))
+}
+
+func TestBuildIndex(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	write := func(users ...*api.User) {
+		assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath, OutputStyle: config.StyleCompact}, users...))
+	}
+	write(CreateTestAPIUser("1", "One", "one@email.com"), CreateTestAPIUser("2", "Two", "two@email.com"))
+
+	conf := config.JSONPluginConfig{FromFile: filePath}
+	getUser := func(key string) (*api.User, error) {
+		JSONplugin := NewJSONPlugin()
+		assert.Nil(JSONplugin.Open(&conf, plugin.OperationTypeRead))
+		defer JSONplugin.Close() // nolint:errcheck // read stats are not used
+		return JSONplugin.GetUser(key)
+	}
+
+	_, err := getUser("2")
+	assert.NotNil(err)
+	assert.Equal(codes.FailedPrecondition, status.Code(err))
+	assert.Regexp(regexp.MustCompile("'.*users.json' has no index, write it with write-index or aserto-idp-json-index"), err.Error())
+
+	err = BuildIndex(&conf)
+	assert.Nil(err)
+
+	user, err := getUser("2")
+	assert.Nil(err)
+	assert.Equal("Two", user.DisplayName)
+
+	write(CreateTestAPIUser("3", "Three", "three@email.com"))
+
+	_, err = getUser("3")
+	assert.NotNil(err)
+	r := regexp.MustCompile("'.*users.json' changed after its index was written, rebuild it with write-index or aserto-idp-json-index")
+	assert.Regexp(r, err.Error())
+
+	err = BuildIndex(&conf)
+	assert.Nil(err)
+
+	user, err = getUser("3")
+	assert.Nil(err)
+	assert.Equal("Three", user.DisplayName)
+}
+
+func TestDeleteByEmailAndIdentity(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	reportFile := filepath.Join(filepath.Dir(filePath), "report.json")
+
+	euan := CreateTestAPIUser("1", "Euan Garden", "euang@acmecorp.com")
+	euan.Identities["euang"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_USERNAME}
+	april := CreateTestAPIUser("2", "April Stewart", "aprils@acmecorp.com")
+	chris := CreateTestAPIUser("3", "Chris Johnson", "aprils@acmecorp.com")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, euan, april, chris))
+
+	conf := config.JSONPluginConfig{
+		FromFile:     filePath,
+		DeleteBy:     config.DeleteByAny,
+		DeleteReport: reportFile,
+	}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Delete("euang"))
+	assert.Nil(JSONplugin.Delete("APRILS@acmecorp.com"))
+	assert.Nil(JSONplugin.Delete("nobody@acmecorp.com"))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	for _, user := range users {
+		assert.True(user.Deleted, user.Id)
+	}
+
+	content, err := os.ReadFile(reportFile)
+	assert.Nil(err)
+	report := deleteReport{}
+	assert.Nil(json.Unmarshal(content, &report))
+	assert.Equal([]*DeleteMatch{
+		{Key: "euang", Users: []string{"1"}},
+		{Key: "APRILS@acmecorp.com", Users: []string{"2", "3"}},
+		{Key: "nobody@acmecorp.com", Users: []string{}},
+	}, report.Matches)
+}
+
+func TestDeleteFilter(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath},
+		CreateTestAPIUser("1", "Euan Garden", "euang@acmecorp.com"),
+		CreateTestAPIUser("2", "April Stewart", "aprils@contractor.com"),
+	))
+
+	conf := config.JSONPluginConfig{
+		FromFile:     filePath,
+		DeleteFilter: "email=*@contractor.com",
+	}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	// the id is not matched as an email
+	assert.Nil(JSONplugin.Delete("euang@acmecorp.com"))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	assert.Equal([]*DeleteMatch{
+		{Key: "euang@acmecorp.com"},
+		{Filter: "email=*@contractor.com", Users: []string{"2"}},
+	}, JSONplugin.DeleteMatches())
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	assert.False(users[0].Deleted)
+	assert.True(users[1].Deleted)
+}
+
+func TestRestore(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath},
+		CreateTestAPIUser("1", "Euan Garden", "euang@acmecorp.com"),
+		CreateTestAPIUser("2", "April Stewart", "aprils@acmecorp.com"),
+	))
+
+	deleteUsers := func(conf *config.JSONPluginConfig, keys ...string) *JSONPlugin {
+		JSONplugin := NewJSONPlugin()
+		JSONplugin.Now = func() time.Time { return time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC) }
+		assert.Nil(JSONplugin.Open(conf, plugin.OperationTypeDelete))
+		for _, key := range keys {
+			assert.Nil(JSONplugin.Delete(key))
+		}
+		_, err := JSONplugin.Close()
+		assert.Nil(err)
+		return JSONplugin
+	}
+	deleteUsers(&config.JSONPluginConfig{FromFile: filePath}, "1", "2")
+
+	JSONplugin := deleteUsers(&config.JSONPluginConfig{FromFile: filePath, Restore: true}, "2", "3")
+	assert.Equal([]*DeleteMatch{
+		{Key: "2", Restore: true, Users: []string{"2"}},
+		{Key: "3", Restore: true},
+	}, JSONplugin.DeleteMatches())
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	assert.True(users[0].Deleted)
+	assert.False(users[1].Deleted)
+	assert.Nil(users[1].Metadata.DeletedAt)
+	assert.Equal("2022-03-04T05:06:07Z", users[1].Metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+
+	tmp, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.Nil(err)
+	assert.Empty(tmp, "the rewrite should not leave temporary files")
+}
+
+func TestWriteDryRun(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	previewDir := filepath.Join(dir, "preview")
+	conf := config.JSONPluginConfig{
+		ToFile:        filepath.Join(dir, "users.json"),
+		ShardMaxUsers: 1,
+		DryRun:        true,
+	}
+
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeWrite)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Write(CreateTestAPIUser("1", "One", "one@email.com")))
+	assert.Nil(JSONplugin.Write(CreateTestAPIUser("2", "Two", "two@email.com")))
+	stats, err := JSONplugin.Close()
+	assert.Nil(err)
+
+	assert.Equal(int32(2), stats.Created)
+	plan := JSONplugin.Plan()
+	assert.Equal(2, plan.Written)
+	assert.Len(plan.Files, 3, "two shards and the manifest")
+	assert.Equal(filepath.Join(dir, "users-0001.json"), plan.Files[0].File)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(err)
+	assert.Empty(entries, "a dry run should not write files")
+
+	conf.PreviewDir = previewDir
+	assert.Nil(writeUsers(&conf, CreateTestAPIUser("1", "One", "one@email.com")))
+	assert.True(FileExists(filepath.Join(previewDir, "users-0001.json")))
+	assert.True(FileExists(filepath.Join(previewDir, "dry-run-plan.json")))
+	assert.False(FileExists(filepath.Join(dir, "users-0001.json")))
+
+	// previews in the directory of to-file would overwrite the files they preview
+	conf.PreviewDir = filepath.Join(dir, ".")
+	err = NewJSONPlugin().Open(&conf, plugin.OperationTypeWrite)
+	assert.NotNil(err)
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	assert.Regexp(regexp.MustCompile("preview-dir '.*' is the directory of '.*users.json'"), err.Error())
+}
+
+func TestDeleteDryRun(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath},
+		CreateTestAPIUser("1", "Euan Garden", "euang@acmecorp.com"),
+		CreateTestAPIUser("2", "April Stewart", "aprils@acmecorp.com"),
+	))
+	before, err := os.ReadFile(filePath)
+	assert.Nil(err)
+
+	JSONplugin := NewJSONPlugin()
+	err = JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath, DryRun: true}, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Delete("2"))
+	assert.Nil(JSONplugin.Delete("3"))
+	stats, err := JSONplugin.Close()
+	assert.Nil(err)
+
+	assert.Equal(int32(2), stats.Received)
+	assert.Equal(int32(1), stats.Deleted)
+	plan := JSONplugin.Plan()
+	assert.Equal(1, plan.Deleted)
+	assert.Len(plan.Matches, 2)
+	assert.Equal([]*PlannedFile{{File: filePath, Bytes: plan.Files[0].Bytes}}, plan.Files)
+
+	after, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	assert.Equal(before, after)
+}
+
+func TestOpenLockedFile(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, CreateTestAPIUser("1", "One", "one@email.com")))
+
+	conf := config.JSONPluginConfig{
+		FromFile:    filePath,
+		ToFile:      filePath,
+		LockTimeout: "100ms",
+	}
+	writer := NewJSONPlugin()
+	err := writer.Open(&conf, plugin.OperationTypeWrite)
+	assert.Nil(err)
+
+	err = NewJSONPlugin().Open(&conf, plugin.OperationTypeDelete)
+	assert.NotNil(err)
+	assert.Equal(codes.Unavailable, status.Code(err))
+	r := regexp.MustCompile("'.*users.json' is locked by another invocation, gave up after 100ms")
+	assert.Regexp(r, err.Error())
+
+	// reads see the previous file until the write renames the new one in place
+	users, err := ReadUsers(&conf)
+	assert.Nil(err)
+	assert.Len(users, 1)
+
+	_, err = writer.Close()
+	assert.Nil(err)
+
+	deleter := NewJSONPlugin()
+	err = deleter.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	_, err = deleter.Close()
+	assert.Nil(err)
+}
+
+func TestCloseAfterLockedOpen(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, CreateTestAPIUser("1", "One", "one@email.com")))
+	content, err := os.ReadFile(filePath)
+	assert.Nil(err)
+
+	conf := config.JSONPluginConfig{
+		FromFile:    filePath,
+		ToFile:      filePath,
+		LockTimeout: "100ms",
+	}
+	holder := NewJSONPlugin()
+	assert.Nil(holder.Open(&conf, plugin.OperationTypeDelete))
+
+	// the plugin SDK closes the plugin after a failed open
+	for _, op := range []plugin.OperationType{plugin.OperationTypeDelete, plugin.OperationTypeWrite} {
+		p := NewJSONPlugin()
+		err = p.Open(&conf, op)
+		assert.Equal(codes.Unavailable, status.Code(err))
+		stats, err := p.Close()
+		assert.Nil(err)
+		assert.Nil(stats)
+
+		actual, err := os.ReadFile(filePath)
+		assert.Nil(err)
+		assert.Equal(string(content), string(actual))
+	}
+
+	_, err = holder.Close()
+	assert.Nil(err)
+
+	users, err := ReadUsers(&conf)
+	assert.Nil(err)
+	assert.Len(users, 1)
+}
+
+func TestDeleteFromMalformedFile(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	content := []byte(`[
+  {"id": "a", "display_name": "A"},
+  {"id": "b", "display_name": "B",},
+  {"id": "c", "display_name": "C"}
+]
+`)
+	assert.Nil(os.WriteFile(filePath, content, 0600))
+
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath}, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.NotNil(JSONplugin.Delete("a"))
+	_, err = JSONplugin.Close()
+	assert.NotNil(err)
+	r := regexp.MustCompile("'.*users.json' is not rewritten, 1 of its records could not be read")
+	assert.Regexp(r, err.Error())
+
+	after, err := os.ReadFile(filePath)
+	assert.Nil(err)
+	assert.Equal(string(content), string(after))
+}
+
+func TestDeleteKeepsUntransformableRecords(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	content := []byte(`[
+  {"id": "a", "display_name": "A"},
+  {"display_name": "No Id"},
+  {"id": "c", "display_name": "C"}
+]
+`)
+	assert.Nil(os.WriteFile(filePath, content, 0600))
+
+	// the id strategy is not applied to the records delete writes back
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath, IDStrategy: "fail"}, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Delete("a"))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	assert.Len(users, 3)
+	assert.True(users[0].Deleted)
+	assert.Equal("", users[1].Id)
+	assert.Equal("No Id", users[1].DisplayName)
+}
+
+func TestDeleteLeavesOtherRecordsUnchanged(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.json")
+	mapFile := filepath.Join(dir, "roles.json")
+	assert.Nil(os.WriteFile(mapFile, []byte(`{"roles": {"user": "member"}}`), 0600))
+
+	euan := CreateTestAPIUser("1", "Euan Garden", "Euang@AcmeCorp.com")
+	euan.Attributes.Roles = []string{"admin", "user"}
+	euan.Identities["Euang@AcmeCorp.com"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_EMAIL}
+	april := CreateTestAPIUser("2", "April Stewart", "aprils@acmecorp.com")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, euan, april))
+
+	records := func() []json.RawMessage {
+		content, err := os.ReadFile(filePath)
+		assert.Nil(err)
+		var raw []json.RawMessage
+		assert.Nil(json.Unmarshal(content, &raw))
+		return raw
+	}
+	before := records()
+
+	conf := config.JSONPluginConfig{
+		FromFile:      filePath,
+		Normalize:     "all",
+		RoleMapFile:   mapFile,
+		UnmappedRoles: "drop",
+	}
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&conf, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	assert.Nil(JSONplugin.Delete("2"))
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	after := records()
+	assert.Len(after, 2)
+	assert.Equal(string(before[0]), string(after[0]))
+	assert.NotEqual(string(before[1]), string(after[1]))
+}
+
+func TestDeleteWithoutKeysKeepsUsers(t *testing.T) {
+	assert := require.New(t)
+
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	assert.Nil(writeUsers(&config.JSONPluginConfig{ToFile: filePath}, CreateTestAPIUser("1", "One", "one@email.com")))
+
+	JSONplugin := NewJSONPlugin()
+	err := JSONplugin.Open(&config.JSONPluginConfig{FromFile: filePath}, plugin.OperationTypeDelete)
+	assert.Nil(err)
+	_, err = JSONplugin.Close()
+	assert.Nil(err)
+
+	users, err := ReadUsers(&config.JSONPluginConfig{FromFile: filePath})
+	assert.Nil(err)
+	assert.Len(users, 1)
 }
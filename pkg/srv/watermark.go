@@ -0,0 +1,60 @@
+package srv
+
+import (
+	"time"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/atomicfile"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// changeTime returns the latest of the creation, update and deletion times of
+// user, zero when it has none.
+func changeTime(user *api.User) time.Time {
+	var latest time.Time
+	m := user.GetMetadata()
+	for _, ts := range []*timestamppb.Timestamp{m.GetCreatedAt(), m.GetUpdatedAt(), m.GetDeletedAt()} {
+		if ts == nil {
+			continue
+		}
+		if t := ts.AsTime(); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// changed returns the users that changed after the since time and records the
+// newest change time seen. Users without any time are always returned.
+func (s *JSONPlugin) changed(users []*api.User) []*api.User {
+	if s.op != plugin.OperationTypeRead {
+		return users
+	}
+
+	stats := s.fileStats[len(s.fileStats)-1]
+	kept := users[:0]
+	for _, user := range users {
+		t := changeTime(user)
+		if t.After(s.newest) {
+			s.newest = t
+		}
+		if t.IsZero() || t.After(s.since) {
+			kept = append(kept, user)
+			continue
+		}
+		stats.Received--
+		stats.Skipped++
+	}
+	return kept
+}
+
+// saveWatermark writes the newest change time read to the watermark file, so that
+// the next read only returns the users changed after it.
+func (s *JSONPlugin) saveWatermark() error {
+	if s.Config.WatermarkFile == "" || s.Config.DryRun || !s.newest.After(s.since) {
+		return nil
+	}
+
+	return atomicfile.WriteFile(s.Config.WatermarkFile, []byte(s.newest.UTC().Format(time.RFC3339Nano)+"\n"), 0600)
+}
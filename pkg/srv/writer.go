@@ -0,0 +1,689 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/atomicfile"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/canonical"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/config"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/extra"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/jsonpath"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/ldif"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/signature"
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/transform"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/aserto-dev/idp-plugin-sdk/plugin"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// output is a document being written to a single file. The users are streamed
+// to the file as they are written, not held until it is finished.
+type output struct {
+	file   string
+	key    string
+	users  *fileWriter
+	count  int
+	suffix []byte
+	// index locates the records of the file, nil when no index is written
+	index *recordIndex
+}
+
+// shard describes a written output file in the index manifest.
+type shard struct {
+	File  string `json:"file"`
+	Key   string `json:"key,omitempty"`
+	Users int    `json:"users"`
+	Bytes int    `json:"bytes"`
+}
+
+// manifestExt replaces the extension of to-file in the name of the index
+// manifest, it is not .json so that reading the output directory skips it.
+const manifestExt = ".shards"
+
+type manifest struct {
+	Shards []*shard `json:"shards"`
+}
+
+func (s *JSONPlugin) sharded() bool {
+	return s.Config.ShardMaxUsers > 0 || s.Config.ShardMaxBytes > 0 || len(s.shardBy) > 0
+}
+
+// newOutput starts a document in the configured format. For JSON output the users
+// array is placed at the users path of template.
+func (s *JSONPlugin) newOutput(file, key string, template []byte) (*output, error) {
+	var prefix []byte
+	out := &output{file: file, key: key}
+	if s.Config.Format == config.FormatLDIF {
+		prefix = []byte(ldif.Header)
+	} else {
+		var err error
+		if prefix, out.suffix, err = jsonpath.Wrap(template, s.path); err != nil {
+			return nil, err
+		}
+		prefix = append(prefix, "[\n"...)
+	}
+
+	users, err := s.createFile(file, true)
+	if err != nil {
+		return nil, err
+	}
+	out.users = users
+	if _, err := out.users.Write(prefix); err != nil {
+		out.users.abort()
+		return nil, err
+	}
+
+	if s.Config.WriteIndex {
+		out.index = newRecordIndex()
+	}
+
+	return out, nil
+}
+
+// outputFor returns the output user is written to, rolling over to a new shard
+// when the current one reached shard-max-users.
+func (s *JSONPlugin) outputFor(user *api.User) (*output, error) {
+	if !s.sharded() {
+		if s.out == nil {
+			out, err := s.newOutput(s.Config.ToFile, "", []byte(s.Config.WriteTemplate))
+			if err != nil {
+				return nil, err
+			}
+			s.out = out
+		}
+		return s.out, nil
+	}
+
+	key := ""
+	if len(s.shardBy) > 0 {
+		value, err := s.shardKey(user)
+		if err != nil {
+			return nil, err
+		}
+		key = value
+	}
+
+	out := s.partitions[key]
+	if out != nil && s.Config.ShardMaxUsers > 0 && out.count >= s.Config.ShardMaxUsers {
+		if err := s.finish(out); err != nil {
+			return nil, err
+		}
+		out = nil
+	}
+
+	if out == nil {
+		var err error
+		out, err = s.newOutput(s.shardFile(key), key, []byte(s.Config.WriteTemplate))
+		if err != nil {
+			return nil, err
+		}
+		s.partitions[key] = out
+	}
+
+	return out, nil
+}
+
+func (s *JSONPlugin) write(out *output, user *api.User) error {
+	b, err := s.marshal(user)
+	if err != nil {
+		return err
+	}
+
+	// roll over before the record would push the shard past shard-max-bytes
+	if s.op == plugin.OperationTypeWrite && s.Config.ShardMaxBytes > 0 && out.count > 0 &&
+		out.users.size+len(b)+s.overhead(out) > s.Config.ShardMaxBytes {
+		if err := s.finish(out); err != nil {
+			return err
+		}
+		next, err := s.newOutput(s.shardFile(out.key), out.key, []byte(s.Config.WriteTemplate))
+		if err != nil {
+			return err
+		}
+		s.partitions[out.key] = next
+		out = next
+	}
+
+	sep := ""
+	if s.Config.Format == config.FormatLDIF {
+		sep = "\n"
+	} else if out.count != 0 {
+		sep = ",\n"
+	}
+	if _, err := out.users.Write([]byte(sep)); err != nil {
+		return err
+	}
+	if out.index != nil {
+		out.index.add(user, int64(out.users.size), int64(len(b)))
+	}
+	if _, err := out.users.Write(b); err != nil {
+		return err
+	}
+	out.count++
+
+	return nil
+}
+
+func (s *JSONPlugin) marshal(user *api.User) ([]byte, error) {
+	if s.Config.Format == config.FormatLDIF {
+		return ldif.Marshal(s.attrMap.ToEntry(user, s.Config.LDIFBaseDN)), nil
+	}
+
+	fields := s.unknown[user]
+	if s.Config.OutputStyle == config.StyleCanonical {
+		user = sortedRoles(user)
+	}
+
+	b, err := s.marshalOptions.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = extra.Merge(b, fields, s.marshalOptions.Indent); err != nil {
+		return nil, err
+	}
+
+	switch s.Config.OutputStyle {
+	case config.StyleCompact:
+		// protojson varies the whitespace of its single line output
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, b); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case config.StyleCanonical:
+		return canonical.Transform(b)
+	}
+
+	return b, nil
+}
+
+// newMarshalOptions returns the protojson options of the configured output style.
+func (s *JSONPlugin) newMarshalOptions() protojson.MarshalOptions {
+	options := jsonOptions
+	options.EmitUnpopulated = s.Config.EmitUnpopulated
+	options.UseEnumNumbers = s.Config.EnumNumbers
+
+	switch s.Config.OutputStyle {
+	case config.StyleCompact, config.StyleCanonical:
+		options.Indent = ""
+	default:
+		if s.Config.Indent > 0 {
+			options.Indent = strings.Repeat(" ", s.Config.Indent)
+		}
+	}
+
+	return options
+}
+
+// sortedRoles returns a copy of user with the roles and permissions of its
+// attributes and applications in lexical order.
+func sortedRoles(user *api.User) *api.User {
+	user = proto.Clone(user).(*api.User)
+
+	attrs := []*api.AttrSet{user.Attributes}
+	for _, app := range user.Applications {
+		attrs = append(attrs, app)
+	}
+	for _, a := range attrs {
+		if a != nil {
+			sort.Strings(a.Roles)
+			sort.Strings(a.Permissions)
+		}
+	}
+
+	return user
+}
+
+// overhead returns the number of bytes added around the next record of out:
+// the separator and the end of the document.
+func (s *JSONPlugin) overhead(out *output) int {
+	if s.Config.Format == config.FormatLDIF {
+		return 1
+	}
+
+	return len(",\n") + len("\n]") + len(out.suffix) + len("\n")
+}
+
+// finish ends the document and puts it in place of its file.
+func (s *JSONPlugin) finish(out *output) error {
+	if s.Config.Format != config.FormatLDIF {
+		end := append(append([]byte("\n]"), out.suffix...), '\n')
+		if _, err := out.users.Write(end); err != nil {
+			return err
+		}
+	}
+
+	size := out.users.size
+	if err := s.commitFile(out.users); err != nil {
+		return err
+	}
+	if name := s.indexed(out); name != "" {
+		if err := s.writeIndex(out.file, name, out.index); err != nil {
+			return err
+		}
+	}
+
+	s.shards = append(s.shards, &shard{
+		File:  filepath.Base(out.file),
+		Key:   out.key,
+		Users: out.count,
+		Bytes: size,
+	})
+
+	return nil
+}
+
+// indexed returns the file the index of out is written for, "" when none is.
+func (s *JSONPlugin) indexed(out *output) string {
+	switch {
+	case out.index == nil:
+		return ""
+	case s.Config.DryRun:
+		return s.preview(out.file)
+	default:
+		return out.file
+	}
+}
+
+// finishAll writes the pending outputs of a write operation and, when sharding,
+// the index manifest listing the shards.
+func (s *JSONPlugin) finishAll() error {
+	if !s.sharded() {
+		if s.out == nil {
+			out, err := s.newOutput(s.Config.ToFile, "", []byte(s.Config.WriteTemplate))
+			if err != nil {
+				return err
+			}
+			s.out = out
+		}
+		return s.finish(s.out)
+	}
+
+	keys := make([]string, 0, len(s.partitions))
+	for key := range s.partitions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := s.finish(s.partitions[key]); err != nil {
+			return err
+		}
+	}
+	s.partitions = map[string]*output{}
+
+	// the shards of the previous write are listed by the manifest replaced
+	previous, err := s.loadManifest()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(&manifest{Shards: s.shards}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeFile(s.manifestFile(), bytes.NewBuffer(append(b, '\n')), false); err != nil {
+		return err
+	}
+
+	return s.removeStaleShards(previous)
+}
+
+// loadManifest returns the manifest of the previous sharded write of to-file,
+// nil when there is none.
+func (s *JSONPlugin) loadManifest() (*manifest, error) {
+	content, err := os.ReadFile(s.manifestFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest '%s': %w", s.manifestFile(), err)
+	}
+	return m, nil
+}
+
+// removeStaleShards deletes the shards of the previous write that this one did
+// not rewrite, along with their signature and index, so that reading the output
+// directory does not return the users they held. Dry runs remove nothing.
+func (s *JSONPlugin) removeStaleShards(previous *manifest) error {
+	if previous == nil || s.Config.DryRun {
+		return nil
+	}
+
+	written := map[string]bool{}
+	for _, sh := range s.shards {
+		written[sh.File] = true
+	}
+
+	dir := filepath.Dir(s.Config.ToFile)
+	for _, sh := range previous.Shards {
+		if written[sh.File] {
+			continue
+		}
+		file := filepath.Join(dir, filepath.Base(sh.File))
+		for _, name := range []string{file, file + signature.ChecksumExt, file + signature.SignatureExt, indexFile(file)} {
+			if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// abortOutputs discards the outputs of a write operation that were not finished.
+func (s *JSONPlugin) abortOutputs() {
+	if s.out != nil {
+		s.out.users.abort()
+	}
+	for _, out := range s.partitions {
+		out.users.abort()
+	}
+}
+
+// abort releases what an operation that is not closed holds: the outputs
+// being written, the spills of the sorter and the lock.
+func (s *JSONPlugin) abort() {
+	s.abortOutputs()
+	if s.sorter != nil {
+		s.sorter.cleanup()
+	}
+	s.unlock() // nolint:errcheck // the lock is released when the file is closed anyway
+}
+
+// shardFile returns the name of the next shard of the partition key, e.g.
+// users-0001.json or users-sales-0001.json for a to-file named users.json.
+func (s *JSONPlugin) shardFile(key string) string {
+	ext := filepath.Ext(s.Config.ToFile)
+	name := strings.TrimSuffix(s.Config.ToFile, ext)
+
+	if len(s.shardBy) > 0 {
+		name += "-" + s.partitionName(key)
+	}
+
+	if s.Config.ShardMaxUsers > 0 || s.Config.ShardMaxBytes > 0 {
+		n := 1
+		for _, sh := range s.shards {
+			if sh.Key == key {
+				n++
+			}
+		}
+		name += fmt.Sprintf("-%04d", n)
+	}
+
+	return name + ext
+}
+
+// partitionName returns the file name part of the partition key. Keys that are
+// sanitized to the same name, such as "R&D" and "R D", or that only differ by
+// case are told apart by a counter: R_D, R_D-2.
+func (s *JSONPlugin) partitionName(key string) string {
+	if part, ok := s.partNames[key]; ok {
+		return part
+	}
+
+	base := unsafeFileChars.ReplaceAllString(key, "_")
+	if base == "" {
+		base = "none"
+	}
+	part := base
+	for n := 2; s.partTaken[strings.ToLower(part)]; n++ {
+		part = fmt.Sprintf("%s-%d", base, n)
+	}
+	s.partNames[key] = part
+	s.partTaken[strings.ToLower(part)] = true
+
+	return part
+}
+
+func (s *JSONPlugin) manifestFile() string {
+	ext := filepath.Ext(s.Config.ToFile)
+	return strings.TrimSuffix(s.Config.ToFile, ext) + manifestExt
+}
+
+// shardKey returns the value of the shard-by field of user. A "*" segment matches
+// every key of a map, in which case the first non empty value in key order is used.
+func (s *JSONPlugin) shardKey(user *api.User) (string, error) {
+	b, err := jsonOptions.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", err
+	}
+
+	return lookup(doc, s.shardBy), nil
+}
+
+func lookup(node interface{}, path []string) string {
+	if len(path) == 0 {
+		switch v := node.(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	if path[0] != "*" {
+		return lookup(obj[path[0]], path[1:])
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if v := lookup(obj[key], path[1:]); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// fileWriter streams the content of a file aside, see atomicfile.File.
+type fileWriter struct {
+	file string // file the content is for
+	// tmp replaces file, or its preview, on commit; nil when a dry run writes nothing
+	tmp *atomicfile.File
+	buf *bufio.Writer
+	enc io.WriteCloser
+	w   io.Writer
+	// size counts the bytes written, before encryption
+	size int
+}
+
+// createFile starts the content of the file name, encrypting it when requested
+// and keys hold a recipient. Dry runs write it to preview-dir, if set.
+func (s *JSONPlugin) createFile(name string, encrypt bool) (*fileWriter, error) {
+	fw := &fileWriter{file: name, w: io.Discard}
+	if s.Config.DryRun {
+		if name = s.preview(name); name == "" {
+			return fw, nil
+		}
+	}
+
+	tmp, err := atomicfile.Create(name, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fw.tmp = tmp
+	fw.buf = bufio.NewWriter(tmp)
+	fw.w = fw.buf
+
+	if encrypt && s.keys.CanEncrypt() {
+		if fw.enc, err = s.keys.Encrypt(fw.buf); err != nil {
+			fw.abort()
+			return nil, err
+		}
+		fw.w = fw.enc
+	}
+
+	return fw, nil
+}
+
+func (fw *fileWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.size += n
+	return n, err
+}
+
+// abort discards the content written, if it was not committed.
+func (fw *fileWriter) abort() {
+	if fw.tmp != nil {
+		fw.tmp.Abort()
+	}
+}
+
+// commitFile puts the content of fw in place of its file and signs it when a
+// signing key is configured.
+func (s *JSONPlugin) commitFile(fw *fileWriter) error {
+	defer fw.abort()
+
+	if s.Config.DryRun {
+		preview := ""
+		if fw.tmp != nil {
+			preview = fw.tmp.Target()
+		}
+		s.plan.Files = append(s.plan.Files, &PlannedFile{File: fw.file, Bytes: fw.size, Preview: preview})
+	}
+	if fw.tmp == nil {
+		return nil
+	}
+
+	if fw.enc != nil {
+		if err := fw.enc.Close(); err != nil {
+			return err
+		}
+	}
+	if err := fw.buf.Flush(); err != nil {
+		return err
+	}
+	if err := fw.tmp.Commit(); err != nil {
+		return err
+	}
+
+	if s.signingKey != nil {
+		return signature.Sign(fw.tmp.Target(), s.signingKey)
+	}
+
+	return nil
+}
+
+// writeFile writes content to the file name, see createFile and commitFile.
+func (s *JSONPlugin) writeFile(name string, content *bytes.Buffer, encrypt bool) error {
+	fw, err := s.createFile(name, encrypt)
+	if err != nil {
+		return err
+	}
+	if _, err := content.WriteTo(fw); err != nil {
+		fw.abort()
+		return err
+	}
+
+	return s.commitFile(fw)
+}
+
+// replacedUser is a user of the to-file replaced by a write.
+type replacedUser struct {
+	digest    [sha256.Size]byte
+	createdAt *timestamppb.Timestamp
+	updatedAt *timestamppb.Timestamp
+}
+
+// loadReplaced returns the users of to-file by id, when update times are filled
+// and a write replaces them. The records are read as written, without the read
+// transforms.
+func (s *JSONPlugin) loadReplaced() (map[string]*replacedUser, error) {
+	if !s.Config.FillTimestamps {
+		return nil, nil
+	}
+	if info, err := os.Stat(s.Config.ToFile); err != nil || info.IsDir() {
+		return nil, nil
+	}
+
+	c := *s.Config
+	c.FromFile = s.Config.ToFile
+	c.Since, c.WatermarkFile, c.CheckpointFile, c.DryRun = "", "", "", false
+
+	reader := NewJSONPlugin()
+	if err := reader.Open(&c, plugin.OperationTypeRead); err != nil {
+		return nil, fmt.Errorf("cannot read the users replaced in '%s': %w", s.Config.ToFile, err)
+	}
+	defer reader.Close() // nolint:errcheck // read stats are not used
+	reader.readTransforms = transform.Chain{&transform.Timestamps{}}
+
+	replaced := map[string]*replacedUser{}
+	for {
+		users, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		// the records that cannot be read are written as new users
+		for _, user := range users {
+			replaced[user.Id] = &replacedUser{
+				digest:    userDigest(user),
+				createdAt: user.GetMetadata().GetCreatedAt(),
+				updatedAt: user.GetMetadata().GetUpdatedAt(),
+			}
+		}
+	}
+
+	return replaced, nil
+}
+
+// stamp sets the times of user, which replaces r. A user written without times
+// keeps the ones of r, and its update time is bumped when its content changed.
+func (r *replacedUser) stamp(user *api.User, stamped bool, timestamps *transform.Timestamps) {
+	if !stamped && r.createdAt != nil && user.Metadata != nil {
+		user.Metadata.CreatedAt = r.createdAt
+		user.Metadata.UpdatedAt = r.updatedAt
+		if user.Metadata.UpdatedAt == nil {
+			user.Metadata.UpdatedAt = r.createdAt
+		}
+	}
+	if userDigest(user) != r.digest {
+		timestamps.Touch(user)
+	}
+}
+
+// userDigest returns the digest of the content of user, its creation and update
+// times aside.
+func userDigest(user *api.User) [sha256.Size]byte {
+	u := proto.Clone(user).(*api.User)
+	if u.Metadata != nil {
+		u.Metadata.CreatedAt, u.Metadata.UpdatedAt = nil, nil
+	}
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(u) // nolint:errcheck // users always marshal
+	return sha256.Sum256(b)
+}
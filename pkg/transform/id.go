@@ -0,0 +1,115 @@
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/google/uuid"
+)
+
+// Strategies assigning an id to users without one.
+const (
+	IDKeep  = "keep"
+	IDFail  = "fail"
+	IDUUID4 = "uuid4"
+	IDUUID5 = "uuid5"
+)
+
+// IDNamespace is the namespace of the UUIDv5 ids derived from identities.
+var IDNamespace = uuid.NewSHA1(uuid.NameSpaceDNS, []byte("idp-plugin-json.aserto.com")) // nolint:gochecknoglobals // constant
+
+var identityKinds = map[string]api.IdentityKind{ // nolint:gochecknoglobals // lookup table
+	"pid":      api.IdentityKind_IDENTITY_KIND_PID,
+	"email":    api.IdentityKind_IDENTITY_KIND_EMAIL,
+	"username": api.IdentityKind_IDENTITY_KIND_USERNAME,
+	"dn":       api.IdentityKind_IDENTITY_KIND_DN,
+	"phone":    api.IdentityKind_IDENTITY_KIND_PHONE,
+}
+
+// IDAssigner gives an id to users without one. UUIDv5 ids are derived from an
+// identity of the selected kind, so that repeated imports assign the same ids.
+type IDAssigner struct {
+	strategy string
+	kind     api.IdentityKind
+
+	// Generated counts the users given a random id, Derived the ones given an id
+	// derived from an identity.
+	Generated int32
+	Derived   int32
+}
+
+// NewIDAssigner returns the assigner of strategy, identity is the kind of the
+// identity the uuid5 strategy derives ids from and defaults to email.
+func NewIDAssigner(strategy, identity string) (*IDAssigner, error) {
+	a := &IDAssigner{strategy: strategy}
+
+	switch strategy {
+	case "", IDKeep, IDFail, IDUUID4:
+	case IDUUID5:
+		if identity == "" {
+			identity = "email"
+		}
+		kind, ok := identityKinds[strings.ToLower(identity)]
+		if !ok {
+			return nil, fmt.Errorf("unknown identity kind '%s'", identity)
+		}
+		a.kind = kind
+	default:
+		return nil, fmt.Errorf("unknown id strategy '%s'", strategy)
+	}
+
+	return a, nil
+}
+
+func (a *IDAssigner) Apply(user *api.User) error {
+	if user.Id != "" {
+		return nil
+	}
+
+	switch a.strategy {
+	case IDFail:
+		return fmt.Errorf("user '%s' has no id", describe(user))
+	case IDUUID4:
+		user.Id = uuid.NewString()
+		a.Generated++
+	case IDUUID5:
+		name := a.identity(user)
+		if name == "" {
+			return fmt.Errorf("user '%s' has no %s identity to derive an id from",
+				describe(user), strings.ToLower(strings.TrimPrefix(a.kind.String(), "IDENTITY_KIND_")))
+		}
+		user.Id = uuid.NewSHA1(IDNamespace, []byte(name)).String()
+		a.Derived++
+	}
+
+	return nil
+}
+
+// identity returns the key of the user identity of the assigner kind, the
+// lowest one when there are several.
+func (a *IDAssigner) identity(user *api.User) string {
+	keys := []string{}
+	for key, identity := range user.Identities {
+		if identity.GetKind() == a.kind {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		if a.kind == api.IdentityKind_IDENTITY_KIND_EMAIL {
+			return user.Email
+		}
+		return ""
+	}
+
+	sort.Strings(keys)
+	return keys[0]
+}
+
+func describe(user *api.User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+	return user.DisplayName
+}
@@ -0,0 +1,65 @@
+package transform
+
+import (
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDAssignerUUID5(t *testing.T) {
+	assert := require.New(t)
+
+	assigner, err := NewIDAssigner(IDUUID5, "")
+	assert.Nil(err)
+
+	first := createTestUser("", "Test Name", "test@email.com")
+	second := createTestUser("", "Other Name", "test@email.com")
+	other := createTestUser("", "Test Name", "other@email.com")
+	for _, user := range []*api.User{first, second, other} {
+		assert.Nil(assigner.Apply(user))
+	}
+
+	assert.Len(first.Id, 36)
+	assert.Equal(first.Id, second.Id, "equal emails should derive equal ids")
+	assert.NotEqual(first.Id, other.Id)
+	assert.Equal(int32(3), assigner.Derived)
+	assert.Equal(int32(0), assigner.Generated)
+
+	kept := createTestUser("1", "Test Name", "test@email.com")
+	assert.Nil(assigner.Apply(kept))
+	assert.Equal("1", kept.Id)
+}
+
+func TestIDAssignerMissingIdentity(t *testing.T) {
+	assert := require.New(t)
+
+	assigner, err := NewIDAssigner(IDUUID5, "username")
+	assert.Nil(err)
+
+	err = assigner.Apply(createTestUser("", "Test Name", "test@email.com"))
+	assert.NotNil(err)
+	assert.Equal("user 'test@email.com' has no username identity to derive an id from", err.Error())
+}
+
+func TestIDAssignerStrategies(t *testing.T) {
+	assert := require.New(t)
+
+	fail, err := NewIDAssigner(IDFail, "")
+	assert.Nil(err)
+	err = fail.Apply(createTestUser("", "Test Name", "test@email.com"))
+	assert.NotNil(err)
+	assert.Equal("user 'test@email.com' has no id", err.Error())
+
+	random, err := NewIDAssigner(IDUUID4, "")
+	assert.Nil(err)
+	user := createTestUser("", "Test Name", "test@email.com")
+	assert.Nil(random.Apply(user))
+	assert.Len(user.Id, 36)
+	assert.Equal(int32(1), random.Generated)
+
+	_, err = NewIDAssigner("sequence", "")
+	assert.NotNil(err)
+	_, err = NewIDAssigner(IDUUID5, "name")
+	assert.NotNil(err)
+}
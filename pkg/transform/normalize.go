@@ -0,0 +1,234 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+)
+
+// Identity normalizers.
+const (
+	NormalizeEmail = "email"
+	NormalizePhone = "phone"
+	NormalizeKeys  = "keys"
+	NormalizeKind  = "kind"
+	NormalizeAll   = "all"
+)
+
+// minNationalDigits is the shortest number given a country code, shorter ones
+// are local numbers that cannot be completed.
+const minNationalDigits = 8
+
+var dnSeparator = regexp.MustCompile(`\s*([,=+])\s*`) // nolint:gochecknoglobals // compiled once
+
+// Normalizer rewrites the identities of a user to a canonical form. Normalized
+// keys that collide are merged into a single identity.
+type Normalizer struct {
+	email       bool
+	phone       bool
+	keys        bool
+	kind        bool
+	countryCode string
+}
+
+// NewNormalizer parses spec, a comma separated list of normalizers such as
+// "email,phone" or "all". countryCode is the calling code given to phone
+// numbers written without one.
+func NewNormalizer(spec, countryCode string) (*Normalizer, error) {
+	n := &Normalizer{countryCode: strings.TrimPrefix(strings.TrimSpace(countryCode), "+")}
+
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case NormalizeEmail:
+			n.email = true
+		case NormalizePhone:
+			n.phone = true
+		case NormalizeKeys:
+			n.keys = true
+		case NormalizeKind:
+			n.kind = true
+		case NormalizeAll:
+			n.email, n.phone, n.keys, n.kind = true, true, true, true
+		default:
+			return nil, fmt.Errorf("unknown normalizer '%s'", name)
+		}
+	}
+
+	for _, c := range n.countryCode {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid phone country code '%s'", countryCode)
+		}
+	}
+
+	return n, nil
+}
+
+// InfersKind reports whether identities without a kind are given one.
+func (n *Normalizer) InfersKind() bool {
+	return n.kind
+}
+
+func (n *Normalizer) Apply(user *api.User) error {
+	if n.email {
+		user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+	}
+
+	keys := make([]string, 0, len(user.Identities))
+	for key := range user.Identities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	identities := make(map[string]*api.IdentitySource, len(keys))
+	for _, key := range keys {
+		identity := user.Identities[key]
+		if identity == nil {
+			identity = &api.IdentitySource{}
+		}
+
+		if n.kind && identity.Kind == api.IdentityKind_IDENTITY_KIND_UNKNOWN {
+			identity.Kind = inferKind(strings.TrimSpace(key))
+		}
+		key = n.normalizeKey(key, identity.Kind)
+
+		if existing, ok := identities[key]; ok {
+			merge(existing, identity)
+			continue
+		}
+		identities[key] = identity
+	}
+	user.Identities = identities
+
+	return nil
+}
+
+func (n *Normalizer) normalizeKey(key string, kind api.IdentityKind) string {
+	switch {
+	case n.email && kind == api.IdentityKind_IDENTITY_KIND_EMAIL:
+		key = strings.ToLower(strings.TrimSpace(key))
+	case n.phone && kind == api.IdentityKind_IDENTITY_KIND_PHONE:
+		if phone, ok := e164(key, n.countryCode); ok {
+			key = phone
+		}
+	}
+
+	if !n.keys {
+		return key
+	}
+
+	key = strings.TrimSpace(key)
+	switch kind {
+	case api.IdentityKind_IDENTITY_KIND_USERNAME:
+		key = strings.ToLower(strings.Join(strings.Fields(key), ""))
+	case api.IdentityKind_IDENTITY_KIND_DN:
+		key = dnSeparator.ReplaceAllString(key, "$1")
+	}
+	return key
+}
+
+// merge folds identity into existing, keeping the attributes known to either.
+func merge(existing, identity *api.IdentitySource) {
+	if existing.Kind == api.IdentityKind_IDENTITY_KIND_UNKNOWN {
+		existing.Kind = identity.Kind
+	}
+	if existing.Provider == "" {
+		existing.Provider = identity.Provider
+	}
+	existing.Verified = existing.Verified || identity.Verified
+}
+
+// inferKind guesses the kind of an identity from its key.
+func inferKind(key string) api.IdentityKind {
+	at := strings.LastIndex(key, "@")
+	switch {
+	case strings.Contains(key, "|"):
+		return api.IdentityKind_IDENTITY_KIND_PID
+	case at > 0 && strings.Contains(key[at:], ".") && !strings.ContainsAny(key, " ="):
+		return api.IdentityKind_IDENTITY_KIND_EMAIL
+	case isPhone(key) && strings.IndexAny(key, "0123456789") >= 0:
+		return api.IdentityKind_IDENTITY_KIND_PHONE
+	case strings.Contains(key, "="):
+		return api.IdentityKind_IDENTITY_KIND_DN
+	default:
+		return api.IdentityKind_IDENTITY_KIND_USERNAME
+	}
+}
+
+// e164 converts a phone number to the E.164 format, "+" followed by up to 15
+// digits. Numbers without a country code take countryCode after dropping their
+// trunk prefix.
+func e164(value, countryCode string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if !isPhone(value) {
+		return value, false
+	}
+
+	digits := strings.Map(func(c rune) rune {
+		if c >= '0' && c <= '9' {
+			return c
+		}
+		return -1
+	}, value)
+
+	switch {
+	case strings.HasPrefix(value, "+"):
+	case strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case countryCode != "":
+		national := strings.TrimPrefix(digits, "0")
+		if len(national) < minNationalDigits {
+			return value, false
+		}
+		digits = countryCode + national
+	default:
+		return value, false
+	}
+
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return value, false
+	}
+	return "+" + digits, true
+}
+
+// ClearEmptyKinds removes the empty identity kinds of a raw aserto user record,
+// which cannot be unmarshaled, leaving them to be inferred.
+func ClearEmptyKinds(record []byte) ([]byte, error) {
+	var user map[string]json.RawMessage
+	if err := json.Unmarshal(record, &user); err != nil {
+		return nil, err
+	}
+
+	raw, ok := user["identities"]
+	if !ok {
+		return record, nil
+	}
+	var identities map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &identities); err != nil {
+		// malformed identities are reported by the unmarshaler
+		return record, nil // nolint:nilerr
+	}
+
+	cleared := false
+	for _, identity := range identities {
+		if kind, ok := identity["kind"]; ok && string(kind) == `""` {
+			delete(identity, "kind")
+			cleared = true
+		}
+	}
+	if !cleared {
+		return record, nil
+	}
+
+	b, err := json.Marshal(identities)
+	if err != nil {
+		return nil, err
+	}
+	user["identities"] = b
+
+	return json.Marshal(user)
+}
@@ -0,0 +1,101 @@
+package transform
+
+import (
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeIdentities(t *testing.T) {
+	assert := require.New(t)
+
+	normalizer, err := NewNormalizer("all", "1")
+	assert.Nil(err)
+
+	user := createTestUser("1", "Test Name", " Test@Email.com ")
+	user.Identities[" Test.User "] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_USERNAME}
+	user.Identities["(804) 555-3384"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_PHONE}
+	user.Identities["uid=test , ou=Sales"] = &api.IdentitySource{Kind: api.IdentityKind_IDENTITY_KIND_DN}
+
+	err = normalizer.Apply(user)
+	assert.Nil(err)
+
+	assert.Equal("test@email.com", user.Email)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_EMAIL, user.Identities["test@email.com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["+18045553383"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["+18045553384"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_USERNAME, user.Identities["test.user"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_DN, user.Identities["uid=test,ou=Sales"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PID, user.Identities["auth0|1"].Kind)
+	assert.Equal(6, len(user.Identities))
+}
+
+func TestNormalizeInfersKind(t *testing.T) {
+	assert := require.New(t)
+
+	normalizer, err := NewNormalizer("kind", "")
+	assert.Nil(err)
+
+	user := &api.User{Identities: map[string]*api.IdentitySource{
+		"auth0|1":            {},
+		"test@email.com":     {},
+		"+1-804-555-3383":    {},
+		"uid=test,ou=People": {},
+		"test":               {},
+	}}
+
+	err = normalizer.Apply(user)
+	assert.Nil(err)
+
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PID, user.Identities["auth0|1"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_EMAIL, user.Identities["test@email.com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["+1-804-555-3383"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_DN, user.Identities["uid=test,ou=People"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_USERNAME, user.Identities["test"].Kind)
+}
+
+func TestNormalizeMergesCollisions(t *testing.T) {
+	assert := require.New(t)
+
+	normalizer, err := NewNormalizer("email", "")
+	assert.Nil(err)
+
+	user := &api.User{Identities: map[string]*api.IdentitySource{
+		"Test@Email.com": {Kind: api.IdentityKind_IDENTITY_KIND_EMAIL, Provider: "auth0", Verified: true},
+		"test@email.com": {Kind: api.IdentityKind_IDENTITY_KIND_EMAIL},
+	}}
+
+	err = normalizer.Apply(user)
+	assert.Nil(err)
+
+	assert.Equal(1, len(user.Identities))
+	assert.Equal("auth0", user.Identities["test@email.com"].Provider)
+	assert.True(user.Identities["test@email.com"].Verified)
+}
+
+func TestE164(t *testing.T) {
+	assert := require.New(t)
+
+	for value, expected := range map[string]string{
+		"+1-804-555-3383":   "+18045553383",
+		"0044 20 7946 0958": "+442079460958",
+		"020 7946 0958":     "+12079460958",
+		"555-3383":          "555-3383",
+		"ext. 42":           "ext. 42",
+	} {
+		phone, _ := e164(value, "1")
+		assert.Equal(expected, phone, value)
+	}
+}
+
+func TestNewNormalizerInvalid(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := NewNormalizer("email,case", "")
+	assert.NotNil(err)
+	assert.Equal("unknown normalizer 'case'", err.Error())
+
+	_, err = NewNormalizer("phone", "+1a")
+	assert.NotNil(err)
+}
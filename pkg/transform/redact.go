@@ -0,0 +1,226 @@
+package transform
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aserto-dev/aserto-idp-plugin-json/pkg/canonical"
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Redaction actions.
+const (
+	Drop = "drop"
+	Mask = "mask"
+	Hash = "hash"
+)
+
+// Redacted fields, "properties.<key>" selects a property of the user and of its applications.
+const (
+	FieldID          = "id"
+	FieldDisplayName = "display_name"
+	FieldEmail       = "email"
+	FieldPicture     = "picture"
+	FieldPhone       = "phone"
+	FieldUsername    = "username"
+	FieldPID         = "pid"
+	propertiesPrefix = "properties."
+)
+
+const hashLength = 16
+
+type rule struct {
+	field  string
+	action string
+}
+
+// Redactor drops, masks or pseudonymizes selected user fields. Hashing uses
+// HMAC-SHA256 with a single key, so equal values hash to equal pseudonyms and a
+// hashed manager property still matches the hashed id of the manager.
+type Redactor struct {
+	rules []rule
+	key   []byte
+}
+
+// NewRedactor parses spec, a comma separated list of field=action pairs such as
+// "email=hash,picture=drop,phone=mask,properties.manager=hash".
+func NewRedactor(spec string, key []byte) (*Redactor, error) {
+	r := &Redactor{key: key}
+
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid redaction '%s'", pair)
+		}
+		field, action := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		switch field {
+		case FieldID, FieldDisplayName, FieldEmail, FieldPicture, FieldPhone, FieldUsername, FieldPID:
+		default:
+			if !strings.HasPrefix(field, propertiesPrefix) || field == propertiesPrefix {
+				return nil, fmt.Errorf("unknown redaction field '%s'", field)
+			}
+		}
+
+		switch action {
+		case Drop, Mask:
+		case Hash:
+			if len(key) == 0 {
+				return nil, errors.New("hash redaction requires a key")
+			}
+		default:
+			return nil, fmt.Errorf("unknown redaction action '%s'", action)
+		}
+
+		r.rules = append(r.rules, rule{field: field, action: action})
+	}
+
+	return r, nil
+}
+
+func (r *Redactor) Apply(user *api.User) error {
+	for _, rl := range r.rules {
+		switch rl.field {
+		case FieldID:
+			user.Id = r.redact(rl.action, user.Id, false)
+		case FieldDisplayName:
+			user.DisplayName = r.redact(rl.action, user.DisplayName, false)
+		case FieldEmail:
+			user.Email = r.redact(rl.action, user.Email, true)
+			r.redactIdentities(user, api.IdentityKind_IDENTITY_KIND_EMAIL, rl.action)
+		case FieldPicture:
+			user.Picture = r.redact(rl.action, user.Picture, false)
+		case FieldPhone:
+			r.redactIdentities(user, api.IdentityKind_IDENTITY_KIND_PHONE, rl.action)
+		case FieldUsername:
+			r.redactIdentities(user, api.IdentityKind_IDENTITY_KIND_USERNAME, rl.action)
+		case FieldPID:
+			r.redactIdentities(user, api.IdentityKind_IDENTITY_KIND_PID, rl.action)
+		default:
+			key := strings.TrimPrefix(rl.field, propertiesPrefix)
+			if err := r.redactProperty(user.GetAttributes(), key, rl.action); err != nil {
+				return err
+			}
+			for _, app := range user.Applications {
+				if err := r.redactProperty(app, key, rl.action); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Redactor) redactIdentities(user *api.User, kind api.IdentityKind, action string) {
+	keys := []string{}
+	for key, identity := range user.Identities {
+		if identity.GetKind() == kind {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		identity := user.Identities[key]
+		delete(user.Identities, key)
+		if redacted := r.redactIdentity(action, key, kind); redacted != "" {
+			user.Identities[redacted] = identity
+		}
+	}
+}
+
+func (r *Redactor) redactIdentity(action, key string, kind api.IdentityKind) string {
+	// provider ids embed the user id after the provider name (auth0|<id>), hashing
+	// only the id keeps them consistent with a hashed user id
+	if kind == api.IdentityKind_IDENTITY_KIND_PID && action == Hash {
+		if i := strings.LastIndex(key, "|"); i >= 0 {
+			return key[:i+1] + r.hash(key[i+1:])
+		}
+	}
+	return r.redact(action, key, kind == api.IdentityKind_IDENTITY_KIND_EMAIL)
+}
+
+func (r *Redactor) redactProperty(attrs *api.AttrSet, key, action string) error {
+	fields := attrs.GetProperties().GetFields()
+	value, ok := fields[key]
+	if !ok {
+		return nil
+	}
+
+	s, isString := value.GetKind().(*structpb.Value_StringValue)
+	switch {
+	case action == Drop:
+		delete(fields, key)
+	case isString:
+		fields[key] = structpb.NewStringValue(r.redact(action, s.StringValue, false))
+	default:
+		// other values are redacted in their canonical JSON encoding, which does
+		// not vary between builds like their text format does
+		b, err := protojson.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if b, err = canonical.Transform(b); err != nil {
+			return err
+		}
+		fields[key] = structpb.NewStringValue(r.redact(action, string(b), false))
+	}
+
+	return nil
+}
+
+func (r *Redactor) redact(action, value string, email bool) string {
+	if value == "" {
+		return value
+	}
+
+	switch action {
+	case Drop:
+		return ""
+	case Mask:
+		return mask(value, email)
+	default:
+		return r.hash(value)
+	}
+}
+
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:hashLength])
+}
+
+// mask keeps the first character of value, the domain of an email and the last
+// four digits of a phone number.
+func mask(value string, email bool) string {
+	runes := []rune(value)
+
+	if email {
+		if i := strings.LastIndex(value, "@"); i > 0 {
+			local := []rune(value[:i])
+			return string(local[0]) + strings.Repeat("*", len(local)-1) + value[i:]
+		}
+	}
+
+	if len(runes) > 4 && isPhone(value) {
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	}
+	return string(runes[0]) + strings.Repeat("*", len(runes)-1)
+}
+
+func isPhone(value string) bool {
+	for _, c := range value {
+		if !strings.ContainsRune("+-() .0123456789", c) {
+			return false
+		}
+	}
+	return true
+}
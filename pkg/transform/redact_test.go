@@ -0,0 +1,85 @@
+package transform
+
+import (
+	"testing"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRedactHashKeepsReferences(t *testing.T) {
+	assert := require.New(t)
+
+	r, err := NewRedactor("id=hash,pid=hash,properties.manager=hash", []byte("secret"))
+	assert.Nil(err)
+
+	manager := createTestUser("2bfaa552-d9a5-41e9-a6c3-5be62b4433c8", "April Stewart", "aprils@acmecorp.com")
+	user := createTestUser("dfdadc39-7335-404d-af66-c77cf13a15f8", "Euan Garden", "euang@acmecorp.com")
+
+	assert.Nil(r.Apply(manager))
+	assert.Nil(r.Apply(user))
+
+	assert.Len(manager.Id, 32)
+	assert.Equal(manager.Id, user.Attributes.Properties.Fields["manager"].GetStringValue())
+	assert.Equal(manager.Id, user.Applications["peoplefinder"].Properties.Fields["manager"].GetStringValue())
+	assert.Contains(user.Identities, "auth0|"+user.Id)
+}
+
+func TestRedactDropAndMask(t *testing.T) {
+	assert := require.New(t)
+
+	r, err := NewRedactor("email=mask,picture=drop,phone=mask,properties.department=drop", nil)
+	assert.Nil(err)
+
+	user := createTestUser("1", "Euan Garden", "euang@acmecorp.com")
+	assert.Nil(r.Apply(user))
+
+	assert.Equal("e****@acmecorp.com", user.Email)
+	assert.Equal("", user.Picture)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_EMAIL, user.Identities["e****@acmecorp.com"].Kind)
+	assert.Equal(api.IdentityKind_IDENTITY_KIND_PHONE, user.Identities["***********3383"].Kind)
+	assert.NotContains(user.Identities, "euang@acmecorp.com")
+	assert.NotContains(user.Attributes.Properties.Fields, "department")
+}
+
+func TestNewRedactorErrors(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := NewRedactor("email=hash", nil)
+	assert.NotNil(err)
+	assert.Equal("hash redaction requires a key", err.Error())
+
+	_, err = NewRedactor("address=drop", nil)
+	assert.NotNil(err)
+	assert.Equal("unknown redaction field 'address'", err.Error())
+
+	_, err = NewRedactor("email=shred", nil)
+	assert.NotNil(err)
+	assert.Equal("unknown redaction action 'shred'", err.Error())
+
+	r, err := NewRedactor("", nil)
+	assert.Nil(err)
+	assert.Nil(r.Apply(createTestUser("1", "Euan Garden", "euang@acmecorp.com")))
+}
+
+func TestRedactHashNonStringProperties(t *testing.T) {
+	assert := require.New(t)
+
+	r, err := NewRedactor("properties.level=hash,properties.remote=hash,properties.office=hash", []byte("secret"))
+	assert.Nil(err)
+
+	office, err := structpb.NewStruct(map[string]interface{}{"floor": 3, "building": "B"})
+	assert.Nil(err)
+	user := createTestUser("1", "Euan Garden", "euang@acmecorp.com")
+	fields := user.Attributes.Properties.Fields
+	fields["level"] = structpb.NewNumberValue(42)
+	fields["remote"] = structpb.NewBoolValue(true)
+	fields["office"] = structpb.NewStructValue(office)
+	assert.Nil(r.Apply(user))
+
+	// the values are hashed in their canonical JSON encoding
+	assert.Equal(r.hash("42"), fields["level"].GetStringValue())
+	assert.Equal(r.hash("true"), fields["remote"].GetStringValue())
+	assert.Equal(r.hash(`{"building":"B","floor":3}`), fields["office"].GetStringValue())
+}
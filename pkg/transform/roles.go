@@ -0,0 +1,128 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+)
+
+// Policies for roles missing from a role mapping.
+const (
+	UnmappedKeep = "keep"
+	UnmappedDrop = "drop"
+	UnmappedFail = "fail"
+)
+
+// RoleTable renames roles and lists the permissions implied by the renamed roles.
+type RoleTable struct {
+	Roles       map[string]string   `json:"roles"`
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// RoleMapping is the content of a role mapping file. Applications without a
+// table of their own are mapped with the table of the user attributes.
+//
+//	{
+//	  "roles": {"sales-engagement-management": "sales"},
+//	  "permissions": {"sales": ["leads.read"]},
+//	  "applications": {
+//	    "peoplefinder": {"roles": {"viewer": "reader"}}
+//	  }
+//	}
+type RoleMapping struct {
+	RoleTable
+	Applications map[string]*RoleTable `json:"applications"`
+}
+
+// RoleMapper rewrites the roles of the user attributes and applications and adds
+// the permissions they imply.
+type RoleMapper struct {
+	mapping  RoleMapping
+	unmapped string
+}
+
+// LoadRoleMapper reads the role mapping file, unmapped is the policy applied to
+// roles the mapping does not list and defaults to keep.
+func LoadRoleMapper(file, unmapped string) (*RoleMapper, error) {
+	switch unmapped {
+	case "":
+		unmapped = UnmappedKeep
+	case UnmappedKeep, UnmappedDrop, UnmappedFail:
+	default:
+		return nil, fmt.Errorf("unknown unmapped role policy '%s'", unmapped)
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &RoleMapper{unmapped: unmapped}
+	if err := json.Unmarshal(content, &m.mapping); err != nil {
+		return nil, fmt.Errorf("invalid role mapping '%s': %w", file, err)
+	}
+
+	return m, nil
+}
+
+func (m *RoleMapper) Apply(user *api.User) error {
+	if user.Attributes != nil {
+		if err := m.mapAttributes(user, "", user.Attributes, &m.mapping.RoleTable); err != nil {
+			return err
+		}
+	}
+
+	for name, app := range user.Applications {
+		table := m.mapping.Applications[name]
+		if table == nil {
+			table = &m.mapping.RoleTable
+		}
+		if err := m.mapAttributes(user, name, app, table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *RoleMapper) mapAttributes(user *api.User, app string, attrs *api.AttrSet, table *RoleTable) error {
+	roles := make([]string, 0, len(attrs.Roles))
+	for _, role := range attrs.Roles {
+		mapped, ok := table.Roles[role]
+		if !ok {
+			switch m.unmapped {
+			case UnmappedDrop:
+				continue
+			case UnmappedFail:
+				if app != "" {
+					return fmt.Errorf("role '%s' of application '%s' of user '%s' is not mapped", role, app, user.Id)
+				}
+				return fmt.Errorf("role '%s' of user '%s' is not mapped", role, user.Id)
+			}
+			mapped = role
+		}
+		roles = appendUnique(roles, mapped)
+	}
+	attrs.Roles = roles
+
+	permissions := attrs.Permissions
+	for _, role := range roles {
+		for _, permission := range table.Permissions[role] {
+			permissions = appendUnique(permissions, permission)
+		}
+	}
+	attrs.Permissions = permissions
+
+	return nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,64 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeRoleMapping(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "roles.json")
+	err := os.WriteFile(file, []byte(`{
+		"roles": {"user": "member", "sales-engagement-management": "sales"},
+		"permissions": {"sales": ["leads.read", "leads.write"]},
+		"applications": {
+			"peoplefinder": {"roles": {"viewer": "reader"}, "permissions": {"reader": ["people.read"]}}
+		}
+	}`), 0600)
+	require.Nil(t, err)
+	return file
+}
+
+func TestRoleMapper(t *testing.T) {
+	assert := require.New(t)
+
+	mapper, err := LoadRoleMapper(writeRoleMapping(t), "")
+	assert.Nil(err)
+
+	user := createTestUser("1", "Test Name", "test@email.com")
+	user.Attributes.Roles = append(user.Attributes.Roles, "acmecorp")
+	err = mapper.Apply(user)
+	assert.Nil(err)
+
+	assert.Equal([]string{"member", "sales", "acmecorp"}, user.Attributes.Roles)
+	assert.Equal([]string{"leads.read", "leads.write"}, user.Attributes.Permissions)
+	assert.Equal([]string{"reader"}, user.Applications["peoplefinder"].Roles)
+	assert.Equal([]string{"people.read"}, user.Applications["peoplefinder"].Permissions)
+}
+
+func TestRoleMapperUnmappedPolicies(t *testing.T) {
+	assert := require.New(t)
+
+	file := writeRoleMapping(t)
+
+	drop, err := LoadRoleMapper(file, UnmappedDrop)
+	assert.Nil(err)
+	user := createTestUser("1", "Test Name", "test@email.com")
+	user.Attributes.Roles = append(user.Attributes.Roles, "acmecorp")
+	assert.Nil(drop.Apply(user))
+	assert.Equal([]string{"member", "sales"}, user.Attributes.Roles)
+
+	fail, err := LoadRoleMapper(file, UnmappedFail)
+	assert.Nil(err)
+	user = createTestUser("1", "Test Name", "test@email.com")
+	user.Attributes.Roles = append(user.Attributes.Roles, "acmecorp")
+	err = fail.Apply(user)
+	assert.NotNil(err)
+	assert.Equal("role 'acmecorp' of user '1' is not mapped", err.Error())
+
+	_, err = LoadRoleMapper(file, "ignore")
+	assert.NotNil(err)
+	assert.Equal("unknown unmapped role policy 'ignore'", err.Error())
+}
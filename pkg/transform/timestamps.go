@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"time"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Timestamps normalizes the metadata timestamps of a user to valid UTC times
+// and, when Fill is set, sets the missing creation and update times.
+type Timestamps struct {
+	Fill bool
+	Now  func() time.Time
+}
+
+func (t *Timestamps) Apply(user *api.User) error {
+	if user.Metadata == nil {
+		if !t.Fill {
+			return nil
+		}
+		user.Metadata = &api.Metadata{}
+	}
+	m := user.Metadata
+
+	m.CreatedAt = utc(m.CreatedAt)
+	m.UpdatedAt = utc(m.UpdatedAt)
+	m.DeletedAt = utc(m.DeletedAt)
+
+	if t.Fill {
+		if m.CreatedAt == nil {
+			m.CreatedAt = timestamppb.New(t.Now().UTC())
+		}
+		if m.UpdatedAt == nil {
+			m.UpdatedAt = timestamppb.New(m.CreatedAt.AsTime())
+		}
+	}
+
+	return nil
+}
+
+// Touch sets the update time of user to now.
+func (t *Timestamps) Touch(user *api.User) {
+	if !t.Fill {
+		return
+	}
+	if user.Metadata == nil {
+		user.Metadata = &api.Metadata{}
+	}
+	user.Metadata.UpdatedAt = timestamppb.New(t.Now().UTC())
+}
+
+// utc drops the out of range fractions left by producers that do not normalize
+// their timestamps, the resulting time is always UTC.
+func utc(ts *timestamppb.Timestamp) *timestamppb.Timestamp {
+	if ts == nil || ts.IsValid() {
+		return ts
+	}
+	return timestamppb.New(ts.AsTime().UTC())
+}
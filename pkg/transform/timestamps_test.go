@@ -0,0 +1,42 @@
+package transform
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTimestampsFill(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	timestamps := &Timestamps{Fill: true, Now: func() time.Time { return now }}
+
+	user := &api.User{Id: "1"}
+	assert.Nil(timestamps.Apply(user))
+	assert.Equal("2022-03-04T04:06:07Z", user.Metadata.CreatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T04:06:07Z", user.Metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+
+	created := timestamppb.New(now.Add(-time.Hour))
+	user = &api.User{Id: "2", Metadata: &api.Metadata{CreatedAt: created}}
+	assert.Nil(timestamps.Apply(user))
+	assert.Equal("2022-03-04T03:06:07Z", user.Metadata.CreatedAt.AsTime().Format(time.RFC3339))
+	assert.Equal("2022-03-04T03:06:07Z", user.Metadata.UpdatedAt.AsTime().Format(time.RFC3339))
+}
+
+func TestTimestampsNormalize(t *testing.T) {
+	assert := require.New(t)
+
+	timestamps := &Timestamps{}
+
+	user := &api.User{Id: "1", Metadata: &api.Metadata{
+		UpdatedAt: &timestamppb.Timestamp{Seconds: 10, Nanos: 1500000000},
+	}}
+	assert.Nil(timestamps.Apply(user))
+	assert.Nil(user.Metadata.CreatedAt, "missing timestamps should only be filled when enabled")
+	assert.Equal(int64(11), user.Metadata.UpdatedAt.Seconds)
+	assert.Equal(int32(500000000), user.Metadata.UpdatedAt.Nanos)
+}
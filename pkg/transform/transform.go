@@ -0,0 +1,22 @@
+package transform
+
+import (
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+)
+
+// Transform modifies a user in place before it is read or written.
+type Transform interface {
+	Apply(user *api.User) error
+}
+
+// Chain applies transforms in order.
+type Chain []Transform
+
+func (c Chain) Apply(user *api.User) error {
+	for _, t := range c {
+		if err := t.Apply(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
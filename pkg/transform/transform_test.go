@@ -0,0 +1,43 @@
+package transform
+
+import (
+	"time"
+
+	api "github.com/aserto-dev/go-grpc/aserto/api/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func createTestUser(id, displayName, email string) *api.User {
+	return &api.User{
+		Id:          id,
+		DisplayName: displayName,
+		Email:       email,
+		Picture:     "https://example.com/" + id + ".jpg",
+		Identities: map[string]*api.IdentitySource{
+			email:             {Kind: api.IdentityKind_IDENTITY_KIND_EMAIL, Provider: "auth0", Verified: true},
+			"auth0|" + id:     {Kind: api.IdentityKind_IDENTITY_KIND_PID, Provider: "auth0", Verified: true},
+			"+1-804-555-3383": {Kind: api.IdentityKind_IDENTITY_KIND_PHONE},
+		},
+		Attributes: &api.AttrSet{
+			Properties: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"department": structpb.NewStringValue("Sales Engagement Management"),
+				"manager":    structpb.NewStringValue("2bfaa552-d9a5-41e9-a6c3-5be62b4433c8"),
+			}},
+			Roles:       []string{"user", "sales-engagement-management"},
+			Permissions: []string{},
+		},
+		Applications: map[string]*api.AttrSet{
+			"peoplefinder": {
+				Properties: &structpb.Struct{Fields: map[string]*structpb.Value{
+					"manager": structpb.NewStringValue("2bfaa552-d9a5-41e9-a6c3-5be62b4433c8"),
+				}},
+				Roles: []string{"viewer"},
+			},
+		},
+		Metadata: &api.Metadata{
+			CreatedAt: timestamppb.New(time.Now()),
+			UpdatedAt: timestamppb.New(time.Now()),
+		},
+	}
+}